@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// --skip-ads时把广告的ts加入跳过列表，返回新增的广告ts数量
+func addAdSegments(gaps map[int]bool, data []byte) int {
+	if !skipAds {
+		return 0
+	}
+	added := 0
+	for index := range parseAdSegments(data) {
+		if !gaps[index] {
+			gaps[index] = true
+			added++
+		}
+	}
+	return added
+}
+
+// 查找EXT-X-DATERANGE中SCTE35-OUT和SCTE35-IN之间的ts序号，m3u8库不解析这个标签。
+// 广告从标签所在的位置开始，按DURATION或者PLANNED-DURATION计算结束位置，没有时长时到SCTE35-IN为止，
+// 不按START-DATE和EXT-X-PROGRAM-DATE-TIME对齐
+func parseAdSegments(data []byte) map[int]bool {
+	ads := make(map[int]bool)
+	index := 0
+	// 下一个ts的开始时间，从m3u8第一个ts算起
+	var pos float64
+	var extinf float64
+	adEnd := -1.0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			extinf, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		case strings.HasPrefix(line, "#EXT-X-DATERANGE:"):
+			attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-DATERANGE:"))
+			if _, ok := attrs["SCTE35-OUT"]; ok {
+				adEnd = math.Inf(1)
+				for _, name := range []string{"DURATION", "PLANNED-DURATION"} {
+					if d, err := strconv.ParseFloat(attrs[name], 64); err == nil && d > 0 {
+						adEnd = pos + d
+						break
+					}
+				}
+			} else if _, ok := attrs["SCTE35-IN"]; ok {
+				adEnd = pos
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			// 开始时间在广告范围内的ts，留一点误差防止时长取整后多跳过一个
+			if pos < adEnd-0.001 {
+				ads[index] = true
+			}
+			pos += extinf
+			extinf = 0
+			index++
+		}
+	}
+	return ads
+}
+
+// 解析 KEY=VALUE,KEY="VALUE" 格式的属性列表，引号中可以有逗号
+func parseAttributes(value string) map[string]string {
+	attrs := make(map[string]string)
+	for value != "" {
+		eq := strings.IndexByte(value, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(value[:eq])
+		value = value[eq+1:]
+		var attr string
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				attr, value = value[1:], ""
+			} else {
+				attr, value = value[1:end+1], value[end+2:]
+			}
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[i+1:]
+			} else {
+				value = ""
+			}
+		} else if i := strings.IndexByte(value, ','); i >= 0 {
+			attr, value = value[:i], value[i+1:]
+		} else {
+			attr, value = value, ""
+		}
+		attrs[name] = attr
+	}
+	return attrs
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// --stop-after-bytes解析后的字节数，0为不限制
+var stopAfter int64
+
+// 达到字节数上限时关闭，分发ts的协程不再取新的ts
+var budgetStop = make(chan struct{})
+var budgetClosed int32
+
+// 达到上限停止时的退出码，和下载失败的1区分
+const exitBudgetReached = 3
+
+// --all-variants时达到上限，不再合并和下载之后的码率
+var errBudgetReached = errors.New("download stopped by --stop-after-bytes")
+
+// 本次下载的字节数达到上限时通知停止，正在下载的ts下载完成后保存进度退出，剩下的ts之后断点续传
+func checkByteBudget() {
+	if stopAfter <= 0 {
+		return
+	}
+	if atomic.LoadInt64(&downloadBytes) < stopAfter {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&budgetClosed, 0, 1) {
+		close(budgetStop)
+	}
+}
+
+// 是否已经达到字节数上限
+func budgetReached() bool {
+	select {
+	case <-budgetStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// 所有下载协程结束后保存进度，输出剩余的ts后退出
+func exitForBudget() {
+	writeJsonFile()
+	downloaded := atomic.LoadInt64(&downloadBytes)
+	var remaining int
+	downloadProcess.status.Range(func(k, v interface{}) bool {
+		if !v.(bool) {
+			remaining++
+		}
+		return true
+	})
+	fmt.Printf("\nstop after downloading %d bytes (--stop-after-bytes %s), %d segments remaining", downloaded, stopAfterBytes, remaining)
+	// 按已下载的ts平均大小估算剩余字节数
+	if count := atomic.LoadInt64(&downloadCount); count > 0 {
+		fmt.Printf(", about %d bytes", downloaded/count*int64(remaining))
+	}
+	fmt.Println(", rerun the same command to continue")
+	os.Exit(exitBudgetReached)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/grafov/m3u8"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// m3u8缓存目录，和配置文件放在一起，例如 ~/.config/m3u8load/manifests
+func manifestCacheDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "m3u8load", "manifests"), nil
+}
+
+// 按链接生成缓存文件名
+func manifestCacheFile(urlStr string) (string, error) {
+	dir, err := manifestCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(urlStr))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".m3u8"), nil
+}
+
+// 读取有效期内的m3u8缓存，没有缓存或者已过期时返回nil
+func loadManifestCache(urlStr string) []byte {
+	if manifestCache <= 0 || noManifestCache || noCache {
+		return nil
+	}
+	name, err := manifestCacheFile(urlStr)
+	if err != nil {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if err != nil || time.Since(info.ModTime()) > manifestCache {
+		return nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	debugLog.Printf("manifest %v loaded from cache %v\n", urlStr, name)
+	return data
+}
+
+// 缓存m3u8，直播的m3u8会不断变化，只缓存master和已结束的media playlist
+func saveManifestCache(urlStr string, playlist m3u8.Playlist, data []byte) {
+	if manifestCache <= 0 || noManifestCache {
+		return
+	}
+	if mpl, ok := playlist.(*m3u8.MediaPlaylist); ok && !mpl.Closed && mpl.MediaType != m3u8.VOD {
+		return
+	}
+	name, err := manifestCacheFile(urlStr)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(name), dirMode); err != nil {
+		return
+	}
+	// 缓存失败不影响下载
+	_ = ioutil.WriteFile(name, data, fileMode)
+}
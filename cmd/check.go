@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check <out path>",
+	Short: "re-hash the downloaded segments against the recorded checksums",
+	Long:  `re-hash the segment files of an output path and compare them with the sha256 recorded in .index, to find bit rot or incomplete writes, exit 1 on any mismatch`,
+	Args:  cobra.ExactArgs(1),
+	Run:   checkFunc,
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
+
+func checkFunc(cmd *cobra.Command, args []string) {
+	dir := filepath.Clean(args[0])
+	name := dir + string(os.PathSeparator) + ".index"
+	if _, err := os.Stat(name); err != nil {
+		exitWithError(errors.New("index file " + name + " not found"))
+	}
+
+	process := &DownloadProcess{}
+	load(name, process)
+	// 按下载时记录的方式读取ts
+	compressSegments = process.Compressed
+	if len(process.Checksums) == 0 {
+		exitWithError(errors.New("no checksums recorded in " + name + ", download it again with this version to record them"))
+	}
+
+	// 按文件名排序，输出顺序稳定
+	names := make([]string, 0, len(process.Checksums))
+	for value := range process.Checksums {
+		names = append(names, value)
+	}
+	sort.Strings(names)
+
+	var passed, failed int
+	for _, value := range names {
+		sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(value)))
+		if err != nil {
+			failed++
+			fmt.Println("missing: " + value)
+			continue
+		}
+		if sum != process.Checksums[value] {
+			failed++
+			fmt.Println("mismatch: " + value)
+			continue
+		}
+		passed++
+	}
+
+	fmt.Printf("%d segments checked, %d ok, %d failed\n", len(names), passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// 计算文件的sha256
+func hashFile(name string) (string, error) {
+	f, err := DownloadOptions.openSegment(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
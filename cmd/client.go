@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 根据参数配置http客户端，m3u8和ts请求共用
+func setupClient() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// 指定出口ip或者网卡
+	localIP, err := parseLocalAddr(localAddr, netInterface)
+	if err != nil {
+		return err
+	}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+
+	// 指定域名解析的ip，格式和curl一样 host:port:ip
+	overrides, err := parseResolve(resolveHosts)
+	if err != nil {
+		return err
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if ip, ok := overrides[addr]; ok {
+			addr = ip
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	tlsConfig := &tls.Config{}
+	// 老旧服务器只支持默认禁用的加密套件，放开限制以便握手
+	if allowInsecureCiphers {
+		fmt.Println("warning: insecure tls cipher suites and tls 1.0 are enabled, the connection may be decrypted by an attacker")
+		tlsConfig.MinVersion = tls.VersionTLS10
+		tlsConfig.CipherSuites = allCipherSuites()
+	}
+	// 双向认证的客户端证书，m3u8和ts请求都会带上
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return fmt.Errorf("--client-cert and --client-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	client.Transport = transport
+	setupWorkerClients(transport, parallel)
+	return nil
+}
+
+// 每个下载协程单独的http客户端，--client-per-worker时使用，默认所有请求共用client
+var workerClients chan *http.Client
+
+// 每个客户端使用相同配置的独立连接池，减少高并发时对连接池的争用
+func setupWorkerClients(transport *http.Transport, n int) {
+	if !clientPerWorker || n < 1 {
+		return
+	}
+	workerClients = make(chan *http.Client, n)
+	for i := 0; i < n; i++ {
+		workerClients <- &http.Client{Transport: transport.Clone(), Timeout: client.Timeout}
+	}
+}
+
+// 获取一个下载用的客户端，用完后调用releaseClient放回
+func acquireClient() *http.Client {
+	if workerClients == nil {
+		return client
+	}
+	return <-workerClients
+}
+
+func releaseClient(c *http.Client) {
+	if workerClients != nil && c != client {
+		workerClients <- c
+	}
+}
+
+// 默认的加密套件加上不安全的加密套件
+func allCipherSuites() []uint16 {
+	var ids []uint16
+	for _, suite := range tls.CipherSuites() {
+		ids = append(ids, suite.ID)
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		ids = append(ids, suite.ID)
+	}
+	return ids
+}
+
+// 解析出口ip，指定网卡时使用网卡的第一个ipv4地址，没有时使用第一个地址
+func parseLocalAddr(addr string, name string) (net.IP, error) {
+	if addr != "" && name != "" {
+		return nil, fmt.Errorf("--local-addr and --interface can not be used together")
+	}
+	if addr != "" {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("local addr %q is not an ip", addr)
+		}
+		return ip, nil
+	}
+	if name == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %q: %w", name, err)
+	}
+	var first net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("interface %q has no ip address", name)
+	}
+	return first, nil
+}
+
+// 解析host:port:ip，返回 host:port -> ip:port
+func parseResolve(values []string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("resolve %q illegal, for example: example.com:443:127.0.0.1", value)
+		}
+		ip := strings.Trim(parts[2], "[]")
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("resolve %q has an illegal ip", value)
+		}
+		overrides[net.JoinHostPort(parts[0], parts[1])] = net.JoinHostPort(ip, parts[1])
+	}
+	return overrides, nil
+}
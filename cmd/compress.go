@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// --compress-segments时ts用gzip压缩保存
+type gzipSegment struct {
+	*gzip.Writer
+	w io.WriteCloser
+}
+
+// 视频数据基本不能再压缩，使用最快的压缩级别减少CPU占用
+func newGzipSegment(w io.WriteCloser) io.WriteCloser {
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return &gzipSegment{Writer: zw, w: w}
+}
+
+func (g *gzipSegment) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.w.Close()
+		return err
+	}
+	return g.w.Close()
+}
+
+// 下载失败时丢弃，临时文件不移动到输出目录
+func (g *gzipSegment) Abort() error {
+	abortSegment(g.w)
+	return nil
+}
+
+// 打开本地的ts文件，进度文件记录为压缩保存时解压，不按文件内容猜测
+func openSegmentFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if !compressSegments {
+		return &decodedBody{Reader: br, body: f}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decodedBody{Reader: zr, body: f}, nil
+}
+
+// ts解压后的大小，和合并文件中的大小一致，没有压缩时直接取文件大小
+func segmentSize(name string) (int64, error) {
+	if !compressSegments {
+		return DownloadOptions.statFile(name)
+	}
+	f, err := DownloadOptions.openSegment(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
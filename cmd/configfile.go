@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+)
+
+// --config指定的配置文件，yaml、json、toml等格式，键为参数的长名字，例如 url、num、header
+var configFile string
+
+func init() {
+	cobra.OnInitialize(loadConfigFile)
+}
+
+// 环境变量的前缀，例如 M3U8LOAD_NUM、M3U8LOAD_USER_AGENT_ROTATE
+const envPrefix = "M3U8LOAD"
+
+// 读取环境变量和配置文件，优先级：命令行 > 环境变量 > 配置文件
+func loadConfigFile() {
+	// 先设置的参数不会被后面覆盖，所以先读环境变量
+	if err := applyConfig(envConfig(), rootCmd.Flags()); err != nil {
+		exitWithError(fmt.Errorf("invalid %s environment variable for %w", envPrefix, err))
+	}
+	if configFile == "" {
+		configFile = os.Getenv(envPrefix + "_CONFIG")
+	}
+	if configFile == "" {
+		return
+	}
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		exitWithError(fmt.Errorf("read config file %s failed: %w", configFile, err))
+	}
+	if err := applyConfig(v, rootCmd.Flags()); err != nil {
+		exitWithError(fmt.Errorf("config file %s: %w", configFile, err))
+	}
+}
+
+// 按参数的长名字读取环境变量，例如 user-agent 对应 M3U8LOAD_USER_AGENT
+func envConfig() *viper.Viper {
+	env := viper.New()
+	env.SetEnvPrefix(envPrefix)
+	env.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	env.AutomaticEnv()
+	return env
+}
+
+// 配置文件或环境变量中的值只用于前面没有设置的参数，列表参数（例如header）可以写成数组
+func applyConfig(v *viper.Viper, flags *pflag.FlagSet) error {
+	known := make(map[string]bool)
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		known[f.Name] = true
+		if err != nil || f.Changed || f.Name == "config" || !v.IsSet(f.Name) {
+			return
+		}
+		value := v.Get(f.Name)
+		values := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		}
+		for _, item := range values {
+			if setErr := flags.Set(f.Name, fmt.Sprint(item)); setErr != nil {
+				err = fmt.Errorf("%s: %v", f.Name, setErr)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range v.AllKeys() {
+		if !known[key] {
+			fmt.Println("warning: unknown option " + key + " in config file " + configFile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// 测试用的参数，和rootCmd中的同名参数类型一样
+type testFlags struct {
+	set       *pflag.FlagSet
+	num       int
+	userAgent string
+	headers   []string
+}
+
+func newTestFlags(t *testing.T, args ...string) *testFlags {
+	t.Helper()
+	f := &testFlags{set: pflag.NewFlagSet("test", pflag.ContinueOnError)}
+	f.set.IntVarP(&f.num, "num", "n", 5, "")
+	f.set.StringVarP(&f.userAgent, "user-agent", "", "", "")
+	f.set.StringArrayVarP(&f.headers, "header", "H", nil, "")
+	if err := f.set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// 配置文件只填充命令行没有指定的参数，列表参数可以写成数组
+func TestConfigFileFlagsWin(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "job.json")
+	data := `{"num": 8, "user-agent": "from-file", "header": ["A: 1", "B: 2"]}`
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(name)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFlags(t, "-n", "3")
+
+	if err := applyConfig(v, f.set); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.num != 3 {
+		t.Errorf("num %d, want the command line value 3", f.num)
+	}
+	if f.userAgent != "from-file" {
+		t.Errorf("user agent %q, want the config file value", f.userAgent)
+	}
+	if len(f.headers) != 2 || f.headers[0] != "A: 1" || f.headers[1] != "B: 2" {
+		t.Errorf("headers %q, want both from the config file", f.headers)
+	}
+}
+
+// 环境变量填充没有指定的参数，命令行指定的参数不被覆盖
+func TestEnvFillsOptions(t *testing.T) {
+	t.Setenv("M3U8LOAD_NUM", "12")
+	t.Setenv("M3U8LOAD_USER_AGENT", "from-env")
+
+	f := newTestFlags(t)
+	if err := applyConfig(envConfig(), f.set); err != nil {
+		t.Fatal(err)
+	}
+	if f.num != 12 || f.userAgent != "from-env" {
+		t.Errorf("num %d user agent %q, want the environment values", f.num, f.userAgent)
+	}
+
+	f = newTestFlags(t, "--num", "3")
+	if err := applyConfig(envConfig(), f.set); err != nil {
+		t.Fatal(err)
+	}
+	if f.num != 3 || f.userAgent != "from-env" {
+		t.Errorf("num %d user agent %q, want 3 from the command line", f.num, f.userAgent)
+	}
+}
+
+// 优先级：命令行 > 环境变量 > 配置文件
+func TestConfigPrecedence(t *testing.T) {
+	t.Setenv("M3U8LOAD_NUM", "12")
+	t.Setenv("M3U8LOAD_USER_AGENT", "from-env")
+	name := filepath.Join(t.TempDir(), "job.json")
+	data := `{"num": 8, "user-agent": "from-file", "header": ["A: 1"]}`
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := viper.New()
+	file.SetConfigFile(name)
+	if err := file.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFlags(t, "--num", "3")
+
+	// 和loadConfigFile的顺序一样，先环境变量再配置文件
+	for _, v := range []*viper.Viper{envConfig(), file} {
+		if err := applyConfig(v, f.set); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f.num != 3 {
+		t.Errorf("num %d, want 3 from the command line", f.num)
+	}
+	if f.userAgent != "from-env" {
+		t.Errorf("user agent %q, want the environment value", f.userAgent)
+	}
+	if len(f.headers) != 1 || f.headers[0] != "A: 1" {
+		t.Errorf("headers %q, want the config file value", f.headers)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+)
+
+// 空包的PID，不检查连续计数
+const tsNullPid = 0x1fff
+
+// 合并时重写ts包的连续计数，每个PID的计数接着上一个ts继续，播放器不会因为计数跳变丢包。
+// 只处理188字节的ts包，同步字节不对的数据原样写入
+type continuityWriter struct {
+	w   io.Writer
+	buf []byte
+	cc  map[uint16]byte
+	// 每个PID上一个包的原始内容，用于识别重复包
+	last map[uint16][]byte
+}
+
+func newContinuityWriter(w io.Writer) *continuityWriter {
+	return &continuityWriter{w: w, cc: make(map[uint16]byte), last: make(map[uint16][]byte)}
+}
+
+func (c *continuityWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	start := 0
+	for len(c.buf)-start >= tsPacketSize {
+		if c.buf[start] != tsSyncByte {
+			// 不是ts包的开头，跳过一个字节重新查找同步字节
+			if _, err := c.w.Write(c.buf[start : start+1]); err != nil {
+				return 0, err
+			}
+			start++
+			continue
+		}
+		packet := c.buf[start : start+tsPacketSize]
+		c.fix(packet)
+		if _, err := c.w.Write(packet); err != nil {
+			return 0, err
+		}
+		start += tsPacketSize
+	}
+	c.buf = append(c.buf[:0], c.buf[start:]...)
+	return len(p), nil
+}
+
+// 有负载的包计数加1，只有调整字段的包计数不变
+func (c *continuityWriter) fix(packet []byte) {
+	pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+	if pid == tsNullPid {
+		return
+	}
+	hasPayload := packet[3]&0x10 != 0
+	// 和上一个包完全相同的是重复包，计数和上一个包相同，不加1
+	if prev, ok := c.last[pid]; ok && hasPayload && bytes.Equal(prev, packet) {
+		packet[3] = packet[3]&0xf0 | c.cc[pid]
+		return
+	}
+	c.last[pid] = append(c.last[pid][:0], packet...)
+	// 设置了discontinuity_indicator的包本身允许计数跳变，保留原计数，之后从它继续
+	if hasDiscontinuity(packet) {
+		c.cc[pid] = packet[3] & 0x0f
+		return
+	}
+	last, seen := c.cc[pid]
+	cc := packet[3] & 0x0f
+	if seen {
+		cc = last
+		if hasPayload {
+			cc = (last + 1) & 0x0f
+		}
+	}
+	packet[3] = packet[3]&0xf0 | cc
+	c.cc[pid] = cc
+}
+
+// 调整字段中的discontinuity_indicator
+func hasDiscontinuity(packet []byte) bool {
+	return packet[3]&0x20 != 0 && packet[4] > 0 && packet[5]&0x80 != 0
+}
+
+// 写入最后不足一个包的数据
+func (c *continuityWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// 脱敏的请求头和响应头
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// --debug-http时输出请求头
+func dumpRequest(req *http.Request) {
+	if !debugHTTP {
+		return
+	}
+	data, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		log.Printf("dump request failed: %v\n", err)
+		return
+	}
+	log.Printf("> request\n%s", redactHeaders(data))
+}
+
+// --debug-http时输出响应状态和响应头
+func dumpResponse(resp *http.Response) {
+	if !debugHTTP {
+		return
+	}
+	data, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		log.Printf("dump response failed: %v\n", err)
+		return
+	}
+	log.Printf("< response %s\n%s", resp.Request.URL, redactHeaders(data))
+}
+
+// --debug-http-redact时隐藏敏感的请求头和响应头的值
+func redactHeaders(data []byte) string {
+	if !debugHTTPRedact {
+		return string(data)
+	}
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, name := range sensitiveHeaders {
+			if strings.HasPrefix(strings.ToLower(line), strings.ToLower(name)+":") {
+				line = name + ": [redacted]"
+				break
+			}
+		}
+		buf.WriteString(line + "\n")
+	}
+	return buf.String()
+}
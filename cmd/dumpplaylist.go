@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// --dump-playlist时把原始m3u8保存到输出目录，文件名按链接生成，直播轮询时覆盖为最新的内容
+func savePlaylistDump(resolvedUrl string, data []byte, listType m3u8.ListType) {
+	if !dumpPlaylist || outPath == "" {
+		return
+	}
+	prefix := "playlist"
+	switch listType {
+	case m3u8.MASTER:
+		prefix = "master"
+	case m3u8.MEDIA:
+		prefix = "media"
+	}
+	sum := sha256.Sum256([]byte(resolvedUrl))
+	name := filepath.Join(outPath, prefix+"-"+hex.EncodeToString(sum[:4])+".m3u8")
+	if err := os.MkdirAll(outPath, dirMode); err != nil {
+		fmt.Printf("dump playlist failed: %v\n", err)
+		return
+	}
+	// 原始内容不做修改，跳转后的链接写入同名的.url文件
+	if err := ioutil.WriteFile(name, data, fileMode); err != nil {
+		fmt.Printf("dump playlist failed: %v\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(name+".url", []byte(resolvedUrl+"\n"), fileMode); err != nil {
+		fmt.Printf("dump playlist failed: %v\n", err)
+		return
+	}
+	debugLog.Printf("playlist %v saved to %v\n", resolvedUrl, name)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// json格式的错误，每行一个写入stderr
+type errorRecord struct {
+	Level  string `json:"level"`
+	Uri    string `json:"uri,omitempty"`
+	Msg    string `json:"msg"`
+	Status int    `json:"status,omitempty"`
+}
+
+func writeErrorRecord(level string, uri string, err error) {
+	record := errorRecord{Level: level, Uri: uri, Msg: err.Error()}
+	var se *statusError
+	if errors.As(err, &se) {
+		record.Status = se.code
+	}
+	data, _ := json.Marshal(record)
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// ts下载失败，--json-errors时输出json
+func reportSegmentError(uri string, err error) {
+	if jsonErrors {
+		writeErrorRecord("error", uri, err)
+	}
+}
+
+// 输出错误后退出，--json-errors时输出json
+func exitWithError(err error) {
+	if jsonErrors {
+		writeErrorRecord("fatal", "", err)
+	} else {
+		fmt.Println(err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+)
+
+// 合并文件被占用时的重试次数，间隔依次翻倍
+const (
+	inUseRetries = 5
+	inUseDelay   = time.Second
+)
+
+// 合并文件被播放器等程序打开时重试，仍然被占用时提示关闭后重新运行，已下载的ts不受影响
+func retryFileInUse(name string, fn func() error) error {
+	delay := inUseDelay
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isFileInUse(err) {
+			return err
+		}
+		if i >= inUseRetries {
+			return fmt.Errorf("output file %s is in use, close the player and retry: %w", name, err)
+		}
+		fmt.Printf("output file %s is in use, retry in %v\n", name, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
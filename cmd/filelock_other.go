@@ -0,0 +1,8 @@
+//go:build !windows
+
+package cmd
+
+// 其它系统删除或覆盖打开中的文件不会失败
+func isFileInUse(err error) bool {
+	return false
+}
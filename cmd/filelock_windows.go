@@ -0,0 +1,18 @@
+//go:build windows
+
+package cmd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ERROR_SHARING_VIOLATION和ERROR_LOCK_VIOLATION，文件被其它程序打开
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+func isFileInUse(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
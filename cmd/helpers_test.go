@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试期间修改全局参数，结束后恢复
+func setGlobal[T any](t testing.TB, p *T, value T) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// 重置下载状态和统计，输出目录为临时目录
+func resetDownload(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	setGlobal(t, &outPath, dir)
+	setGlobal(t, &parallel, 4)
+	setGlobal(t, &segmentRetry, 0)
+	setGlobal(t, &playlistRetry, 0)
+	setGlobal(t, &retryFailed, 0)
+	setGlobal(t, &maxSegmentSize, int64(1<<30))
+	setGlobal(t, &downloadProcess, &DownloadProcess{dir: dir, status: &sync.Map{}})
+	setGlobal(t, &client, &http.Client{})
+	for _, n := range []*int64{&downloadBytes, &downloadCount, &doneDuration, &totalDuration, &failedCount, &activeCount, &notFoundCount, &checkpointStep} {
+		atomic.StoreInt64(n, 0)
+	}
+	playlistTags.Range(func(k, v interface{}) bool {
+		playlistTags.Delete(k)
+		return true
+	})
+	// 失败的ts会打印日志，测试时不输出
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	startBar(0)
+	return dir
+}
+
+// 按路径返回固定内容的服务器，不存在的路径返回404
+func newSegmentServer(t testing.TB, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 把ts放入队列并用下载协程下载到dir
+func downloadAll(dir string, list []*Download) {
+	dlc := make(chan *Download, len(list))
+	for _, v := range list {
+		downloadProcess.status.Store(v.Name, false)
+		dlc <- v
+	}
+	close(dlc)
+	downloadSegmentLimit(dir, dlc)
+}
+
+// 生成n个ts包大小的数据
+func tsData(packets int, fill byte) []byte {
+	data := make([]byte, packets*tsPacketSize)
+	for i := range data {
+		data[i] = fill
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		data[i] = tsSyncByte
+	}
+	return data
+}
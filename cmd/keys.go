@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/grafov/m3u8"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// SegmentKey ts的EXT-X-KEY，ts不解密，只记录下来方便之后用其它工具解密
+type SegmentKey struct {
+	// 加密方式，例如 AES-128
+	Method string
+	// 密钥的绝对链接，不下载密钥
+	URI string
+	// 没有写IV时为媒体序列号
+	IV string
+}
+
+var encryptedWarning sync.Once
+
+// 记录ts的密钥信息，调用时需要持有downloadProcess的锁
+func setSegmentKey(name string, key *m3u8.Key, seq uint64, playlistUrl *url.URL) {
+	if key == nil || key.Method == "" || strings.EqualFold(key.Method, "NONE") {
+		return
+	}
+	encryptedWarning.Do(func() {
+		log.Println("warning: segments are encrypted and saved without decryption, the key uri and iv are kept in the state file")
+	})
+	iv := key.IV
+	if iv == "" {
+		iv = fmt.Sprintf("0x%032x", seq)
+	}
+	if downloadProcess.Keys == nil {
+		downloadProcess.Keys = make(map[string]SegmentKey)
+	}
+	downloadProcess.Keys[name] = SegmentKey{
+		Method: key.Method,
+		URI:    getAbsoluteUri(key.URI, playlistUrl),
+		IV:     iv,
+	}
+}
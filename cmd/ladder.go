@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// 本地m3u8文件名
+const (
+	localMasterName = "master.m3u8"
+	localMediaName  = "index.m3u8"
+)
+
+// 下载master playlist的所有码率，每个码率保存到 v0、v1 等子目录，最后生成本地的master playlist
+func downloadAllVariants(urlStr string) error {
+	playlistUrl, err := url.Parse(urlStr)
+	if err != nil {
+		log.Panic(err)
+	}
+	playlist, listType, _ := fetchPlaylist(urlStr)
+	if listType != m3u8.MASTER {
+		log.Panic("--all-variants needs a master playlist: " + urlStr)
+	}
+	mpl := playlist.(*m3u8.MasterPlaylist)
+
+	root := outPath
+	local := m3u8.NewMasterPlaylist()
+	for i, variant := range mpl.Variants {
+		// I帧列表只用于快进预览，不下载
+		if variant == nil || variant.Iframe {
+			continue
+		}
+		dir := "v" + strconv.Itoa(i)
+		fmt.Printf("variant %d/%d bandwidth %d resolution %s -> %s\n", i+1, len(mpl.Variants), variant.Bandwidth, variant.Resolution, dir)
+
+		// 每个码率单独的进度文件和统计
+		variantPath := filepath.Join(root, dir)
+		resetDownloadProcess()
+		for _, n := range []*int64{&downloadBytes, &downloadCount, &doneDuration, &totalDuration, &failedCount, &notFoundCount, &checkpointStep} {
+			atomic.StoreInt64(n, 0)
+		}
+
+		downloadPlaylist(getAbsoluteUri(variant.URI, playlistUrl), variantPath)
+		finishBar()
+		fmt.Println("")
+		if budgetReached() {
+			return errBudgetReached
+		}
+		if err := writeAndMergeFile(variantPath, variantPath); err != nil {
+			return err
+		}
+		if err := writeLocalPlaylist(variantPath); err != nil {
+			return err
+		}
+
+		// 音频字幕等不下载，本地的master playlist中去掉引用
+		params := variant.VariantParams
+		params.Alternatives = nil
+		params.Audio = ""
+		params.Video = ""
+		params.Subtitles = ""
+		local.Append(dir+"/"+localMediaName, nil, params)
+	}
+
+	name := filepath.Join(root, localMasterName)
+	if err := ioutil.WriteFile(name, local.Encode().Bytes(), fileMode); err != nil {
+		return err
+	}
+	fmt.Println("local master playlist: " + name)
+	return nil
+}
+
+// 清空上一个码率的下载进度，其它地方持有的downloadProcess仍然有效
+func resetDownloadProcess() {
+	downloadProcess.Lock()
+	defer downloadProcess.Unlock()
+	downloadProcess.Path = ""
+	downloadProcess.MediaStatus = nil
+	downloadProcess.MediaList = nil
+	downloadProcess.MediaUrl = ""
+	downloadProcess.Bandwidth = 0
+	downloadProcess.Resolution = ""
+	downloadProcess.Mirror = ""
+	downloadProcess.AudioUrl = ""
+	downloadProcess.AudioPath = ""
+	downloadProcess.AudioList = nil
+	downloadProcess.ContentType = ""
+	downloadProcess.AudioContentType = ""
+	downloadProcess.Ranges = nil
+	downloadProcess.DataUris = nil
+	downloadProcess.Durations = nil
+	downloadProcess.Checksums = nil
+	downloadProcess.Sizes = nil
+	downloadProcess.Keys = nil
+	downloadProcess.MergePath = ""
+	downloadProcess.MergeExt = ""
+	downloadProcess.Compressed = false
+	downloadProcess.Live = false
+	downloadProcess.LastSeq = 0
+	downloadProcess.dir = ""
+	downloadProcess.status = &sync.Map{}
+}
+
+// 根据已下载的ts生成本地的media playlist，失败的ts不写入
+func writeLocalPlaylist(outPath string) error {
+	var buf bytes.Buffer
+	var target float64
+	for _, name := range downloadProcess.MediaList {
+		target = math.Max(target, downloadProcess.Durations[name])
+	}
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	buf.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(int(math.Ceil(target))) + "\n")
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	for _, name := range downloadProcess.MediaList {
+		if done, _ := downloadProcess.status.Load(name); done != true {
+			continue
+		}
+		buf.WriteString("#EXTINF:" + strconv.FormatFloat(downloadProcess.Durations[name], 'f', 3, 64) + ",\n")
+		buf.WriteString(name + "\n")
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return ioutil.WriteFile(filepath.Join(outPath, localMediaName), buf.Bytes(), fileMode)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// 下载队列，监控时读取队列长度
+var downloadQueue atomic.Value
+
+// 启动prometheus监控，文本格式输出指标
+func startMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	fmt.Println("metrics listen on " + addr + "/metrics")
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Print(err)
+		}
+	}()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var queued int
+	if dlc, ok := downloadQueue.Load().(chan *Download); ok {
+		queued = len(dlc)
+	}
+
+	writeMetric(w, "m3u8load_segments_downloaded_total", "counter", "Segments downloaded successfully.", atomic.LoadInt64(&downloadCount))
+	writeMetric(w, "m3u8load_segments_failed_total", "counter", "Segments failed to download.", atomic.LoadInt64(&failedCount))
+	writeMetric(w, "m3u8load_downloaded_bytes_total", "counter", "Bytes of segments downloaded.", atomic.LoadInt64(&downloadBytes))
+	writeMetric(w, "m3u8load_active_downloads", "gauge", "Segments currently downloading.", atomic.LoadInt64(&activeCount))
+	writeMetric(w, "m3u8load_queue_depth", "gauge", "Segments waiting in the download queue.", int64(queued))
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
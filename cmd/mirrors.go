@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 测速时最多读取的字节数
+const probeBytes = 1 << 20
+
+// 同一码率有多个镜像链接时，同时请求每个链接的第一个ts测速，选择最快的
+func fastestMirror(candidates []*m3u8.Variant, playlistUrl *url.URL) *m3u8.Variant {
+	speeds := make([]float64, len(candidates))
+	wg := sync.WaitGroup{}
+	for i, v := range candidates {
+		wg.Add(1)
+		go func(i int, v *m3u8.Variant) {
+			defer wg.Done()
+			speed, err := probeMirror(getAbsoluteUri(v.URI, playlistUrl))
+			if err != nil {
+				fmt.Printf("probe mirror %s failed: %v\n", v.URI, err)
+				return
+			}
+			fmt.Printf("probe mirror %s: %.2f MB/s\n", v.URI, speed/1024/1024)
+			speeds[i] = speed
+		}(i, v)
+	}
+	wg.Wait()
+
+	best := 0
+	for i, speed := range speeds {
+		if speed > speeds[best] {
+			best = i
+		}
+	}
+	return candidates[best]
+}
+
+// 请求media playlist和第一个ts，返回ts的下载速度，字节每秒
+func probeMirror(urlStr string) (float64, error) {
+	// 和下载时一样带上Accept和--playlist-header
+	playlist, listType, _, err := requestPlaylist(urlStr)
+	// 测速的响应不作为之后请求的ETag，否则选中的镜像会返回304
+	playlistTags.Delete(urlStr)
+	if err != nil {
+		return 0, err
+	}
+	if playlist == nil || listType != m3u8.MEDIA {
+		return 0, errors.New("not a media playlist")
+	}
+	mpl := playlist.(*m3u8.MediaPlaylist)
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return 0, err
+	}
+	var first *m3u8.MediaSegment
+	for _, seg := range mpl.Segments {
+		if seg != nil && seg.URI != "" {
+			first = seg
+			break
+		}
+	}
+	if first == nil {
+		return 0, errors.New("no segments")
+	}
+
+	start := time.Now()
+	resp, err := probeGet(getAbsoluteUri(first.URI, base), nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, probeBytes))
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start).Seconds()
+	if n == 0 || elapsed <= 0 {
+		return 0, errors.New("empty response")
+	}
+	return float64(n) / elapsed, nil
+}
+
+// extra为m3u8请求额外的请求头，ts请求为nil
+func probeGet(urlStr string, extra http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequestWith(client, req, extra)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, &statusError{resp.StatusCode, urlStr}
+	}
+	return resp, nil
+}
+
+// 和选中码率带宽、分辨率都相同，链接不同的码率，作为镜像
+func sameQualityVariants(mpl *m3u8.MasterPlaylist, variant *m3u8.Variant) []*m3u8.Variant {
+	var list []*m3u8.Variant
+	seen := make(map[string]bool)
+	for _, v := range mpl.Variants {
+		if v == nil || v.Iframe || seen[v.URI] {
+			continue
+		}
+		if v.Bandwidth == variant.Bandwidth && v.Resolution == variant.Resolution {
+			seen[v.URI] = true
+			list = append(list, v)
+		}
+	}
+	return list
+}
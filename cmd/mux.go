@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// 视频和单独的音轨合并成一个mp4，需要安装ffmpeg
+func muxAudio(mergePath string) error {
+	if len(downloadProcess.AudioList) == 0 {
+		fmt.Println("no separate audio track, skip mux")
+		return nil
+	}
+	if splitSize != "" || splitCount > 0 {
+		return errors.New("--mux can not be used with --split-size or --split-count")
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errors.New("--mux needs ffmpeg in PATH")
+	}
+	ext := mergeExtension()
+	video := mergePath + ext
+	audio := mergePath + ".audio" + audioExtension()
+	output := mergePath + ".mp4"
+	if ext == ".mp4" {
+		output = mergePath + ".muxed.mp4"
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpeg, "-y", "-loglevel", "error", "-i", video, "-i", audio,
+		"-map", "0:v:0", "-map", "1:a:0", "-c", "copy", output)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// 编码不能直接放入mp4时ffmpeg会报错，原样输出方便排查
+		return fmt.Errorf("ffmpeg mux %s and %s failed: %v\n%s", video, audio, err, strings.TrimSpace(stderr.String()))
+	}
+	fmt.Println("muxed file: " + output)
+	return nil
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Options 嵌入调用时的可选配置，回调为nil时忽略
+type Options struct {
+	// ts文件开始下载
+	OnSegmentStart func(uri string)
+	// ts文件下载完成，bytes为写入的字节数
+	OnSegmentDone func(uri string, bytes int64)
+	// ts文件下载失败
+	OnSegmentError func(uri string, err error)
+	// 创建ts文件，name为本地路径，默认写入本地文件，可以写入内存、网络等其它存储
+	CreateSegment func(name string) (io.WriteCloser, error)
+	// 读取ts文件用于合并，和CreateSegment对应
+	OpenSegment func(name string) (io.ReadCloser, error)
+	// 创建合并文件
+	CreateOutput func(name string) (io.WriteCloser, error)
+	// 查询CreateSegment、CreateOutput写入的文件大小，不存在时返回错误，用于断点续传、分段和校验
+	StatFile func(name string) (int64, error)
+}
+
+// DownloadOptions 当前使用的配置，需要在Execute之前设置
+var DownloadOptions = &Options{}
+
+func (o *Options) segmentStart(uri string) {
+	if o != nil && o.OnSegmentStart != nil {
+		o.OnSegmentStart(uri)
+	}
+}
+
+func (o *Options) segmentDone(uri string, bytes int64) {
+	if o != nil && o.OnSegmentDone != nil {
+		o.OnSegmentDone(uri, bytes)
+	}
+}
+
+func (o *Options) segmentError(uri string, err error) {
+	if o != nil && o.OnSegmentError != nil {
+		o.OnSegmentError(uri, err)
+	}
+}
+
+func (o *Options) createSegment(name string) (io.WriteCloser, error) {
+	if o != nil && o.CreateSegment != nil {
+		return o.CreateSegment(name)
+	}
+	var w io.WriteCloser
+	var err error
+	if tempDir != "" {
+		w, err = createTempSegment(name)
+	} else {
+		// 保留目录结构时需要先创建子目录
+		if err := os.MkdirAll(filepath.Dir(name), dirMode); err != nil {
+			return nil, err
+		}
+		w, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+	}
+	if err != nil || !compressSegments {
+		return w, err
+	}
+	return newGzipSegment(w), nil
+}
+
+func (o *Options) openSegment(name string) (io.ReadCloser, error) {
+	if o != nil && o.OpenSegment != nil {
+		return o.OpenSegment(name)
+	}
+	return openSegmentFile(name)
+}
+
+func (o *Options) statFile(name string) (int64, error) {
+	if o != nil && o.StatFile != nil {
+		return o.StatFile(name)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (o *Options) createOutput(name string) (io.WriteCloser, error) {
+	if o != nil && o.CreateOutput != nil {
+		return o.CreateOutput(name)
+	}
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"container/heap"
+)
+
+// 按列表位置排序的待下载ts，位置相同时视频和音频交替
+type downloadHeap []*Download
+
+func (h downloadHeap) Len() int            { return len(h) }
+func (h downloadHeap) Less(i, j int) bool  { return h[i].Order < h[j].Order }
+func (h downloadHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *downloadHeap) Push(x interface{}) { *h = append(*h, x.(*Download)) }
+func (h *downloadHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return v
+}
+
+// --order in-order时读取下载队列中的所有ts，空闲的下载协程总是先拿到位置最靠前的ts，
+// 边下载边输出时需要缓存的ts更少，但是队列中的ts都要先读出来排序
+func orderedQueue(dlc chan *Download) chan *Download {
+	out := make(chan *Download)
+	go func() {
+		defer close(out)
+		h := &downloadHeap{}
+		in := dlc
+		for in != nil || h.Len() > 0 {
+			// 没有待下载的ts时只读取队列
+			var send chan *Download
+			var next *Download
+			if h.Len() > 0 {
+				send = out
+				next = (*h)[0]
+			}
+			select {
+			case v, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				heap.Push(h, v)
+			case send <- next:
+				heap.Pop(h)
+			}
+		}
+	}()
+	return out
+}
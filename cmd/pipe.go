@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 等待下一个ts下载完成的间隔，也是等待管道读取方的间隔
+const pipePollInterval = 200 * time.Millisecond
+
+// 下载结束后最多再等待读取方打开管道的时间
+var pipeReaderTimeout = 30 * time.Second
+
+// 命名管道还没有读取方
+var errPipeNoReader = errors.New("no reader on the pipe")
+
+// 边下载边按顺序写入合并文件或者命名管道，ffmpeg等可以实时读取命名管道
+type pipeStream struct {
+	name    string
+	outPath string
+	// 为true时写入普通的合并文件，name不带扩展名，第一个ts完成时确定
+	merge bool
+	// 所有ts都已按顺序写入
+	complete bool
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// 边下载边合并完成的视频文件，最后合并时跳过
+var streamedOutput string
+
+// 判断文件是否是已经存在的命名管道
+func isNamedPipe(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// 合并文件是否为命名管道，还没有下载ts，扩展名为--ext或者默认的.ts
+func namedPipeOutput(mergePath string) (string, bool) {
+	name := mergePath + mergeExtension()
+	return name, isNamedPipe(name)
+}
+
+// 后台写入命名管道，下载结束后调用wait
+func startPipeStream(outPath string, name string) *pipeStream {
+	fmt.Println("streaming segments to pipe " + name)
+	return startStream(&pipeStream{name: name, outPath: outPath})
+}
+
+// --concurrent-merge时后台按顺序合并已完成的ts，mergePath不带扩展名
+func startMergeStream(outPath string, mergePath string) *pipeStream {
+	return startStream(&pipeStream{name: mergePath, outPath: outPath, merge: true})
+}
+
+func startStream(p *pipeStream) *pipeStream {
+	p.done = make(chan struct{})
+	p.finished = make(chan struct{})
+	go p.run()
+	return p
+}
+
+// 通知下载已经结束，等待剩下的ts写入
+func (p *pipeStream) wait() {
+	close(p.done)
+	<-p.finished
+	if p.merge && p.complete {
+		streamedOutput = p.name
+	}
+}
+
+func (p *pipeStream) run() {
+	defer close(p.finished)
+	defer catchException()
+
+	var out io.WriteCloser
+	var writer *bufio.Writer
+	var cw *continuityWriter
+	defer func() {
+		if out == nil {
+			return
+		}
+		if cw != nil {
+			cw.Flush()
+		}
+		if writer != nil {
+			writer.Flush()
+		}
+		out.Close()
+	}()
+
+	downloaded := false
+	for i := 0; ; {
+		name, ok := p.segment(i)
+		if ok && isDone(name) {
+			if out == nil {
+				var err error
+				if out, err = p.open(); err != nil {
+					fmt.Printf("open %s failed: %v\n", p.name, err)
+					return
+				}
+				var w io.Writer = out
+				if p.merge {
+					writer = bufio.NewWriterSize(out, 1<<20)
+					w = writer
+				}
+				if fixContinuity && strings.HasSuffix(p.name, ".ts") {
+					cw = newContinuityWriter(w)
+				}
+			}
+			var w io.Writer = out
+			switch {
+			case cw != nil:
+				w = cw
+			case writer != nil:
+				w = writer
+			}
+			if err := copySegment(w, filepath.Join(p.outPath, filepath.FromSlash(name))); err != nil {
+				// 读取方关闭了管道，停止写入，下载继续
+				if errors.Is(err, syscall.EPIPE) {
+					fmt.Println("pipe " + p.name + " closed by reader, stop streaming")
+					return
+				}
+				// 合并文件缺少ts时最后重新合并
+				if p.merge {
+					fmt.Printf("concurrent merge stopped at segment %s: %v\n", name, err)
+					return
+				}
+				fmt.Printf("skip segment %s: %v\n", name, err)
+			}
+			i++
+			continue
+		}
+		// 下载结束后失败的ts，管道直接跳过，合并文件停止，最后重新合并
+		if downloaded {
+			if !ok {
+				p.complete = out != nil
+				return
+			}
+			if p.merge {
+				return
+			}
+			fmt.Println("skip segment " + name + ": not downloaded")
+			i++
+			continue
+		}
+		select {
+		case <-p.done:
+			downloaded = true
+		case <-time.After(pipePollInterval):
+		}
+	}
+}
+
+// 命名管道等待读取方打开，合并文件按第一个ts确定扩展名
+func (p *pipeStream) open() (io.WriteCloser, error) {
+	if !p.merge {
+		return p.openPipe()
+	}
+	downloadProcess.Lock()
+	ext := mergeExtension()
+	downloadProcess.Unlock()
+	p.name += ext
+	return DownloadOptions.createOutput(p.name)
+}
+
+// 没有读取方时定时重试，下载结束后超过pipeReaderTimeout仍然没有读取方时放弃，ts保留在输出目录
+func (p *pipeStream) openPipe() (io.WriteCloser, error) {
+	done := p.done
+	var timeout <-chan time.Time
+	for {
+		f, err := openPipeWriter(p.name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, errPipeNoReader) {
+			return nil, err
+		}
+		select {
+		case <-done:
+			done = nil
+			timeout = time.After(pipeReaderTimeout)
+		case <-timeout:
+			return nil, fmt.Errorf("no reader opened the pipe within %v after the download finished, segments are kept in %s", pipeReaderTimeout, p.outPath)
+		case <-time.After(pipePollInterval):
+		}
+	}
+}
+
+// 第i个ts，直播时列表还会增加
+func (p *pipeStream) segment(i int) (string, bool) {
+	downloadProcess.Lock()
+	defer downloadProcess.Unlock()
+	if i >= len(downloadProcess.MediaList) {
+		return "", false
+	}
+	return downloadProcess.MediaList[i], true
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// 非阻塞打开命名管道，没有读取方时返回errPipeNoReader，不会一直阻塞
+func openPipeWriter(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return nil, errPipeNoReader
+	}
+	return f, err
+}
@@ -0,0 +1,83 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 准备好已完成的ts和命名管道
+func pipeFixture(t *testing.T) (string, string) {
+	dir := resetDownload(t)
+	downloadProcess.MediaList = []string{"a.ts", "b.ts"}
+	for _, name := range downloadProcess.MediaList {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), tsData(1, 0), 0644); err != nil {
+			t.Fatal(err)
+		}
+		setMediaStatus(name, true)
+	}
+	fifo := filepath.Join(t.TempDir(), "out.ts")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skip("mkfifo:", err)
+	}
+	return dir, fifo
+}
+
+// 一直没有读取方时，下载结束后等待pipeReaderTimeout就放弃，不会一直阻塞
+func TestPipeNoReaderTimeout(t *testing.T) {
+	dir, fifo := pipeFixture(t)
+	setGlobal(t, &pipeReaderTimeout, 300*time.Millisecond)
+
+	stream := startPipeStream(dir, fifo)
+	finished := make(chan struct{})
+	go func() {
+		stream.wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe stream still blocked without a reader")
+	}
+}
+
+// 读取方晚于下载打开管道时仍然收到所有ts
+func TestPipeLateReader(t *testing.T) {
+	dir, fifo := pipeFixture(t)
+
+	stream := startPipeStream(dir, fifo)
+	var got []byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(2 * pipePollInterval)
+		got, _ = ioutil.ReadFile(fifo)
+	}()
+	stream.wait()
+	wg.Wait()
+
+	if want := bytes.Repeat(tsData(1, 0), 2); !bytes.Equal(got, want) {
+		t.Errorf("reader got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// --ext指定的扩展名的命名管道也边下载边写入
+func TestPipeWithForcedExtension(t *testing.T) {
+	_, fifo := pipeFixture(t)
+	setGlobal(t, &forceExt, "mpg")
+	name := strings.TrimSuffix(fifo, ".ts") + ".mpg"
+	if err := syscall.Mkfifo(name, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pipeName, ok := namedPipeOutput(strings.TrimSuffix(fifo, ".ts")); !ok || pipeName != name {
+		t.Errorf("named pipe %s not detected, got %q", name, pipeName)
+	}
+}
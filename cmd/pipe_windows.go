@@ -0,0 +1,10 @@
+//go:build windows
+
+package cmd
+
+import "os"
+
+// windows的文件系统中没有命名管道，不会走到这里
+func openPipeWriter(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY, 0)
+}
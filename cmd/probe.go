@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"github.com/spf13/cobra"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe <m3u8 url>",
+	Short: "check whether a stream can be downloaded without downloading it",
+	Long:  `fetch the playlist, report master or media, the variants or the segment count, encryption and drm, and check that the first segment is reachable, exit 1 when the stream can not be downloaded`,
+	Args:  cobra.ExactArgs(1),
+	Run:   probeFunc,
+}
+
+var probeJson bool
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+	probeCmd.Flags().BoolVarP(&probeJson, "json", "", false, "print the result as json")
+}
+
+// probe的检查结果
+type probeResult struct {
+	URL          string        `json:"url"`
+	Type         string        `json:"type,omitempty"`
+	Variants     []variantInfo `json:"variants,omitempty"`
+	MediaUrl     string        `json:"media_url,omitempty"`
+	Segments     int           `json:"segments"`
+	Duration     float64       `json:"duration"`
+	Live         bool          `json:"live"`
+	Independent  bool          `json:"independent_segments"`
+	Encryption   string        `json:"encryption,omitempty"`
+	Drm          string        `json:"drm,omitempty"`
+	FirstSegment string        `json:"first_segment,omitempty"`
+	Status       int           `json:"first_segment_status,omitempty"`
+	Downloadable bool          `json:"downloadable"`
+	Error        string        `json:"error,omitempty"`
+}
+
+func probeFunc(cmd *cobra.Command, args []string) {
+	result := &probeResult{URL: args[0]}
+	err := setupClient()
+	if err == nil {
+		err = probeStream(result)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Downloadable = err == nil && result.Drm == ""
+
+	if probeJson {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		printProbeResult(result)
+	}
+	if !result.Downloadable {
+		os.Exit(1)
+	}
+}
+
+// 获取m3u8，master时按下载时的规则选择码率，再请求第一个ts
+func probeStream(result *probeResult) error {
+	playlist, listType, base, err := probePlaylist(result.URL)
+	if err != nil {
+		return err
+	}
+	if listType == m3u8.MASTER {
+		result.Type = "master"
+		master := playlist.(*m3u8.MasterPlaylist)
+		for _, v := range master.Variants {
+			if v == nil {
+				continue
+			}
+			result.Variants = append(result.Variants, variantInfo{
+				Bandwidth:  v.Bandwidth,
+				Resolution: v.Resolution,
+				Codecs:     v.Codecs,
+				Iframe:     v.Iframe,
+				URL:        getAbsoluteUri(v.URI, base),
+			})
+		}
+		variant := selectVariant(master)
+		if variant == nil {
+			return errors.New("no variant in the master playlist")
+		}
+		result.MediaUrl = getAbsoluteUri(variant.URI, base)
+		if playlist, listType, base, err = probePlaylist(result.MediaUrl); err != nil {
+			return err
+		}
+		if listType != m3u8.MEDIA {
+			return errors.New("variant is not a media playlist")
+		}
+	} else {
+		result.Type = "media"
+	}
+
+	mpl := playlist.(*m3u8.MediaPlaylist)
+	result.Live = !mpl.Closed && mpl.MediaType != m3u8.VOD
+	result.Independent = atomic.LoadInt32(&independentSegments) == 1
+	var first *m3u8.MediaSegment
+	key := mpl.Key
+	for _, seg := range mpl.Segments {
+		if seg == nil {
+			continue
+		}
+		result.Segments++
+		result.Duration += seg.Duration
+		if first == nil && seg.URI != "" {
+			first = seg
+		}
+		if key == nil && seg.Key != nil {
+			key = seg.Key
+		}
+	}
+	if key != nil && key.Method != "" && !strings.EqualFold(key.Method, "NONE") {
+		result.Encryption = key.Method
+		// SAMPLE-AES或者非identity的KEYFORMAT为FairPlay、Widevine等DRM，无法解密
+		if strings.HasPrefix(strings.ToUpper(key.Method), "SAMPLE-AES") || (key.Keyformat != "" && key.Keyformat != "identity") {
+			result.Drm = key.Keyformat
+			if result.Drm == "" {
+				result.Drm = key.Method
+			}
+		}
+	}
+	if first == nil {
+		return errors.New("no segments in the media playlist")
+	}
+
+	// 只请求第一个包，不下载整个ts
+	result.FirstSegment = getAbsoluteUri(first.URI, base)
+	req, err := http.NewRequest("GET", result.FirstSegment, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", tsPacketSize-1))
+	resp, err := doRequest(client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return &statusError{resp.StatusCode, result.FirstSegment}
+	}
+	return nil
+}
+
+// 请求并解析m3u8，出错时返回错误，不退出
+func probePlaylist(urlStr string) (m3u8.Playlist, m3u8.ListType, *url.URL, error) {
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	resp, err := probeGet(urlStr, playlistHeaders)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	data, err := readPlaylist(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	playlist, listType, err := decodePlaylist(urlStr, data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return playlist, listType, base, nil
+}
+
+func printProbeResult(result *probeResult) {
+	fmt.Println("url: " + result.URL)
+	if result.Type != "" {
+		fmt.Println("type: " + result.Type)
+	}
+	for _, v := range result.Variants {
+		fmt.Printf("  variant bandwidth %d resolution %s %s\n", v.Bandwidth, v.Resolution, v.URL)
+	}
+	if result.MediaUrl != "" {
+		fmt.Println("selected variant: " + result.MediaUrl)
+	}
+	if result.Segments > 0 {
+		fmt.Printf("segments: %d, duration %.1fs, live %v, independent segments %v\n", result.Segments, result.Duration, result.Live, result.Independent)
+	}
+	if result.Encryption != "" {
+		fmt.Println("encryption: " + result.Encryption)
+	}
+	if result.Drm != "" {
+		fmt.Println("drm: " + result.Drm + ", can not be downloaded")
+	}
+	if result.Status != 0 {
+		fmt.Printf("first segment: HTTP %d\n", result.Status)
+	}
+	if result.Error != "" {
+		fmt.Println("error: " + result.Error)
+	}
+	fmt.Printf("downloadable: %v\n", result.Downloadable)
+}
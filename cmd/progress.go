@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/cheggaaa/pb/v3"
+	"io/ioutil"
+)
+
+// 按字节显示进度时的进度条，总数为所有ts的字节数
+const byteBarTemplate = `{{counters . }} {{bar . }} {{percent . }} {{speed . }} {{rtime . "ETA %s"}}`
+
+// 按字节显示的进度条，默认按ts个数显示时为nil
+var byteBar *pb.ProgressBar
+
+// 按ts个数的进度条仍然用于统计，按字节显示时不输出
+func startProgress(total int) {
+	if progressMode == "bytes" {
+		bar = pb.ProgressBarTemplate(barTemplate).New(total).SetWriter(ioutil.Discard).Start()
+		if byteBar == nil {
+			byteBar = pb.ProgressBarTemplate(byteBarTemplate).New(0).Set(pb.Bytes, true).Start()
+		}
+	} else {
+		bar = pb.ProgressBarTemplate(barTemplate).Start(total)
+	}
+}
+
+// 结束进度条
+func finishBar() {
+	bar.Finish()
+	if byteBar != nil {
+		byteBar.Finish()
+		byteBar = nil
+	}
+}
+
+// 按字节显示时增加总字节数，字节范围的ts入队时增加，其它ts收到响应时增加
+func addByteTotal(n int64) {
+	if byteBar != nil && n > 0 {
+		byteBar.AddTotal(n)
+	}
+}
+
+// 写入ts文件时按字节更新进度
+type byteProgress struct{}
+
+func (byteProgress) Write(p []byte) (int, error) {
+	if byteBar != nil {
+		byteBar.Add(len(p))
+	}
+	return len(p), nil
+}
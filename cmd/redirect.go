@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// 已经提示过的跳转，key为 原host -> 新host，每对只提示一次
+var hostRedirects sync.Map
+
+// ts被302跳转到其它CDN时提示，跳转到其它域名后Go不会再带上Authorization、Cookie和自定义的Host
+func logHostRedirect(v *Download, resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	u, err := url.Parse(v.URI)
+	if err != nil {
+		return
+	}
+	from, to := u.Host, resp.Request.URL.Host
+	if from == to {
+		return
+	}
+	if _, loaded := hostRedirects.LoadOrStore(from+" -> "+to, true); loaded {
+		debugLog.Printf("segment %v redirected to %v\n", v.URI, resp.Request.URL)
+		return
+	}
+	log.Printf("segment %v redirected from host %v to %v\n", v.Name, from, to)
+}
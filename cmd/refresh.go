@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 重新获取m3u8的最小间隔，多个ts同时403时只请求一次
+const refreshInterval = 5 * time.Second
+
+// 重新获取的m3u8中的ts链接，按url路径对应，token在参数中变化
+var signedUris = struct {
+	sync.Mutex
+	fetched map[string]time.Time
+	uris    map[string]string
+}{fetched: make(map[string]time.Time), uris: make(map[string]string)}
+
+// ts链接签名过期时获取新的链接，优先使用--segment-url-transform，否则重新获取m3u8
+func refreshSegmentUri(v *Download) (string, error) {
+	if segmentUrlTransform != "" {
+		out, err := exec.Command(segmentUrlTransform, v.URI).Output()
+		if err != nil {
+			return "", fmt.Errorf("segment url transform: %w", err)
+		}
+		uri := strings.TrimSpace(string(out))
+		if uri == "" {
+			return "", errors.New("segment url transform returned an empty url")
+		}
+		return uri, nil
+	}
+
+	playlistUrl := downloadProcess.MediaUrl
+	if strings.HasPrefix(v.Name, audioDir+"/") {
+		playlistUrl = downloadProcess.AudioUrl
+	}
+	if playlistUrl == "" {
+		return "", errors.New("no playlist url to refresh")
+	}
+	key, err := uriPath(v.URI)
+	if err != nil {
+		return "", err
+	}
+
+	signedUris.Lock()
+	defer signedUris.Unlock()
+	if time.Since(signedUris.fetched[playlistUrl]) > refreshInterval {
+		if err := refreshPlaylistUris(playlistUrl); err != nil {
+			return "", err
+		}
+		signedUris.fetched[playlistUrl] = time.Now()
+	}
+	uri, ok := signedUris.uris[key]
+	if !ok {
+		return "", fmt.Errorf("segment %v not found in the refreshed playlist", key)
+	}
+	return uri, nil
+}
+
+// 重新获取m3u8，记录每个ts的新链接
+func refreshPlaylistUris(urlStr string) error {
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	// 去掉上次的ETag并且不使用缓存，保证拿到新的m3u8
+	playlistTags.Delete(urlStr)
+	playlist, _, data, err := requestPlaylist(urlStr)
+	if err != nil {
+		return err
+	}
+	mpl, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		return errors.New("refreshed playlist is not a media playlist: " + urlStr)
+	}
+	// 缓存中的签名已经过期，换成新的
+	saveManifestCache(urlStr, playlist, data)
+	for _, seg := range mpl.Segments {
+		if seg == nil || seg.URI == "" {
+			continue
+		}
+		uri := getAbsoluteUri(seg.URI, base)
+		if key, err := uriPath(uri); err == nil {
+			signedUris.uris[key] = uri
+		}
+	}
+	return nil
+}
+
+// ts链接去掉参数后的部分，签名变化时仍然对应同一个ts
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host + u.Path, nil
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"net/url"
+	"strings"
+)
+
+// --refresh-url的m3u8中每个ts的新链接，按去掉参数的文件名对应
+var refreshedUris map[string]string
+
+// 文件名去掉url参数，token变化时仍然对应同一个ts
+func refreshKey(name string) string {
+	return strings.SplitN(name, "?", 2)[0]
+}
+
+// 断点续传时用新的m3u8链接替换过期的链接，已下载的ts和进度不变，未完成的ts从新链接下载
+func applyRefreshUrl(urlStr string) error {
+	// 过期的链接不能使用缓存
+	playlist, _, _, err := requestPlaylist(urlStr)
+	if err != nil {
+		return fmt.Errorf("--refresh-url: %w", err)
+	}
+	mediaUrl := urlStr
+	if master, ok := playlist.(*m3u8.MasterPlaylist); ok {
+		base, err := url.Parse(urlStr)
+		if err != nil {
+			return err
+		}
+		variant := matchVariant(master)
+		if variant == nil {
+			return errors.New("--refresh-url master playlist has no variant: " + urlStr)
+		}
+		mediaUrl = getAbsoluteUri(variant.URI, base)
+		if playlist, _, _, err = requestPlaylist(mediaUrl); err != nil {
+			return fmt.Errorf("--refresh-url: %w", err)
+		}
+	}
+	mpl, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		return errors.New("--refresh-url is not a media playlist: " + mediaUrl)
+	}
+	base, err := url.Parse(mediaUrl)
+	if err != nil {
+		return err
+	}
+	uris := make(map[string]string)
+	for _, seg := range mpl.Segments {
+		if seg == nil || seg.URI == "" {
+			continue
+		}
+		uri := getAbsoluteUri(seg.URI, base)
+		uris[refreshKey(getFileName(uri))] = uri
+	}
+
+	// 和保存的列表比对，一个都对应不上时说明不是同一个视频
+	matched, missing := 0, 0
+	for _, name := range downloadProcess.MediaList {
+		if _, ok := downloadProcess.DataUris[name]; ok {
+			continue
+		}
+		file := name
+		if r, ok := downloadProcess.Ranges[name]; ok {
+			file = r.File
+		}
+		if _, ok := uris[refreshKey(file)]; ok {
+			matched++
+		} else {
+			missing++
+		}
+	}
+	if matched == 0 {
+		return errors.New("the playlist of --refresh-url does not match the saved segments: " + urlStr)
+	}
+	if missing > 0 {
+		fmt.Printf("warning: %d saved segments are not in the refreshed playlist, they keep the old url\n", missing)
+	}
+	if downloadProcess.AudioUrl != "" {
+		fmt.Println("warning: --refresh-url only refreshes the video segments, audio segments keep the old url")
+	}
+	refreshedUris = uris
+	downloadProcess.MediaUrl = mediaUrl
+	return nil
+}
+
+// 选择和上次相同带宽和分辨率的码率，没有时重新选择
+func matchVariant(mpl *m3u8.MasterPlaylist) *m3u8.Variant {
+	for _, v := range mpl.Variants {
+		if v != nil && !v.Iframe && v.Bandwidth == downloadProcess.Bandwidth && v.Resolution == downloadProcess.Resolution {
+			return v
+		}
+	}
+	fmt.Println("warning: the saved variant is not in the master playlist, select again")
+	return selectVariant(mpl)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ts响应读到一半连接断开时，从断开的位置继续请求，不重新下载已经写入的部分。
+// 未压缩的响应用Range从断开的位置继续，服务器不支持Range或者响应经过压缩时重新请求整个ts并跳过已读取的字节
+type resumeBody struct {
+	c *http.Client
+	v *Download
+	io.ReadCloser
+	// 响应内容在文件中的开始位置，字节范围的ts返回206时为v.Offset
+	base int64
+	// 已经读取的字节数
+	read    int64
+	encoded bool
+	retries int
+}
+
+func newResumeBody(c *http.Client, v *Download, resp *http.Response) *resumeBody {
+	r := &resumeBody{c: c, v: v, ReadCloser: resp.Body}
+	_, r.encoded = resp.Body.(*decodedBody)
+	if resp.StatusCode == http.StatusPartialContent && v.Limit > 0 {
+		r.base = v.Offset
+	}
+	return r
+}
+
+func (r *resumeBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if err == nil || err == io.EOF || r.retries >= segmentRetry {
+		return n, err
+	}
+	r.retries++
+	debugLog.Printf("segment %v broken after %d bytes, resume: %v\n", r.v.URI, r.read, err)
+	if resumeErr := r.resume(); resumeErr != nil {
+		return n, fmt.Errorf("%v, resume failed: %v", err, resumeErr)
+	}
+	return n, nil
+}
+
+// 重新请求剩下的部分
+func (r *resumeBody) resume() error {
+	r.ReadCloser.Close()
+	req, err := http.NewRequest("GET", r.v.URI, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", segmentAccept)
+	pos := r.base + r.read
+	if !r.encoded {
+		if r.v.Limit > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", pos, r.v.Offset+r.v.Limit-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pos))
+		}
+	}
+	resp, err := doRequest(r.c, req)
+	if err != nil {
+		return err
+	}
+	var skip int64
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && !r.encoded:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != pos {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+		skip = 0
+	case resp.StatusCode == http.StatusOK:
+		// 返回整个文件，跳过已经读取的部分，压缩的响应base为0
+		skip = pos
+	default:
+		resp.Body.Close()
+		return &statusError{resp.StatusCode, r.v.URI}
+	}
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, skip); err != nil {
+		resp.Body.Close()
+		return err
+	}
+	r.ReadCloser = resp.Body
+	return nil
+}
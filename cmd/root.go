@@ -1,8 +1,17 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/golang/groupcache/lru"
 	"github.com/grafov/m3u8"
@@ -10,13 +19,21 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -31,6 +48,23 @@ var rootCmd = &cobra.Command{
 
 type Download struct {
 	URI string
+	// 本地文件名，相对输出目录
+	Name string
+	// ts时长，单位秒
+	Duration float64
+	// 字节范围，Limit为0时下载整个文件
+	Offset int64
+	Limit  int64
+	// 在视频或者音频列表中的位置，按顺序下载时越小越优先
+	Order int
+}
+
+// 字节范围，多个ts在同一个文件中时使用
+type ByteRange struct {
+	// 所在的文件名
+	File   string
+	Offset int64
+	Limit  int64
 }
 
 type DownloadProcess struct {
@@ -40,6 +74,48 @@ type DownloadProcess struct {
 	MediaStatus map[string]bool
 	// 下载的ts文件列表
 	MediaList []string
+	// 实际下载的media playlist链接，master时为选中码率的链接
+	MediaUrl string
+	// 选中码率的带宽
+	Bandwidth uint32
+	// 选中码率的分辨率
+	Resolution string
+	// --probe-mirrors测速选中的镜像链接
+	Mirror string
+	// 音频的media playlist链接
+	AudioUrl string
+	// 音频下载路径
+	AudioPath string
+	// 音频ts文件列表，保存在audio子目录
+	AudioList []string
+	// 视频ts文件的Content-Type
+	ContentType string
+	// 音频ts文件的Content-Type，和视频分开记录
+	AudioContentType string
+	// 字节范围的ts文件
+	Ranges map[string]ByteRange
+	// data:链接的ts文件，内容直接在链接中
+	DataUris map[string]string
+	// ts文件的时长，生成本地m3u8时使用
+	Durations map[string]float64
+	// ts文件的sha256，用于事后检查文件是否损坏
+	Checksums map[string]string
+	// 开始写入前记录的ts字节数，来自Content-Length或者字节范围，断点续传时判断失败的ts是否完整
+	Sizes map[string]int64
+	// 加密ts的密钥链接和IV，没有加密的ts不记录
+	Keys map[string]SegmentKey
+	// 合并文件的绝对路径，不带扩展名，--name时和ts目录不同，verify按这个路径检查
+	MergePath string
+	// 合并文件的扩展名，--ext时为指定的扩展名
+	MergeExt string
+	// ts文件是否用gzip压缩保存，读取时按这个解压
+	Compressed bool
+	// 是否为未结束的直播
+	Live bool
+	// 已经加入下载列表的最后一个媒体序列号，直播断点续传时从下一个开始
+	LastSeq uint64
+	// ts文件目录，进度文件也写在这里
+	dir string
 	// ts文件内部状态
 	status *sync.Map
 	// 同步锁
@@ -47,13 +123,186 @@ type DownloadProcess struct {
 }
 
 var (
-	parallel int
-	m3u8Url  string
-	outPath  string
+	parallel             int
+	m3u8Url              string
+	outPath              string
+	maxRps               int
+	playlistRetry        int
+	preservePaths        bool
+	validateTs           bool
+	concurrentPlaylists  bool
+	metricsAddr          string
+	sizeSamples          int
+	noClobber            bool
+	resolveHosts         []string
+	stripQuery           bool
+	logFile              string
+	maxSegmentSize       int64
+	startSegment         int
+	startSeq             uint64
+	segmentRetry         int
+	stateExport          string
+	traceRequests        bool
+	maxDuration          time.Duration
+	mergeSync            int
+	onlyVariants         bool
+	pace                 string
+	splitSize            string
+	splitCount           int
+	allowInsecureCiphers bool
+	allVariants          bool
+	allowGaps            bool
+	clientCert           string
+	clientKey            string
+	flat                 bool
+	progressMode         string
+	keepGoing            int
+	fileModeFlag         string
+	dirModeFlag          string
+	manifestCache        time.Duration
+	noManifestCache      bool
+	localAddr            string
+	netInterface         string
+	segmentUrlTransform  string
+	jsonErrors           bool
+	maxSegments          int
+	preview              bool
+	writeLocal           bool
+	verifySegments       bool
+	startTimeFlag        string
+	endTimeFlag          string
+	queueSize            int
+	queryFlags           []string
+	headerFlags          []string
+	playlistHeaderFlags  []string
+	maxPlaylistSize      string
+	mux                  bool
+	retryFailed          int
+	skipAds              bool
+	noCache              bool
+	timingCsv            string
+	refreshUrl           string
+	stopAfterBytes       string
+	fixContinuity        bool
+	concurrentMerge      bool
+	compressSegments     bool
+	forceExt             string
+	outputName           string
+	tempDir              string
+	clientPerWorker      bool
+	jsonSummary          bool
+	summaryFile          string
+	stateFile            string
+	rotateUserAgent      bool
+	userAgentFile        string
+	probeMirrors         bool
+	failFast             bool
+	dedupCacheSize       int
+	sampleSegments       int
+	iframesOnly          bool
+	resumePolicy         string
+	debugHTTP            bool
+	debugHTTPRedact      bool
+	checkpointPercent    int
+	downloadOrder        string
+	dumpPlaylist         bool
+	liveIdleTimeout      time.Duration
+)
+
+// 直播去重缓存的最小长度
+const defaultDedupCacheSize = 1024
+
+// --fail-fast时只退出一次
+var failFastOnce sync.Once
+
+// 追加到每个请求链接的参数
+type queryParam struct {
+	key   string
+	value string
+}
+
+var queryParams []queryParam
+
+// 下载队列的默认和最大长度
+const (
+	defaultQueueSize = 1024
+	maxQueueSize     = 1 << 16
+)
+
+// --preview时默认下载的ts个数
+const previewSegments = 10
+
+// 默认的Accept请求头，可以用--header覆盖
+const (
+	playlistAccept = "application/vnd.apple.mpegurl, application/x-mpegurl;q=0.9, */*;q=0.8"
+	segmentAccept  = "*/*"
+)
+
+// 创建的文件和目录的权限，实际权限还会受umask影响
+var (
+	fileMode os.FileMode = 0644
+	dirMode  os.FileMode = 0755
+)
+
+// 直播轮询m3u8的最小和最大间隔
+const (
+	minPollInterval = time.Second
+	maxPollInterval = time.Minute
+)
+
+// TargetDuration异常只提示一次
+var targetDurationWarning sync.Once
+
+// 按时间截取的开始和结束时间，零值不限制
+var clipStart, clipEnd time.Time
+
+// 直播已经出现结束时间之后的ts
+var clipEndReached bool
+
+// 没有EXT-X-PROGRAM-DATE-TIME只提示一次
+var programDateTimeWarning sync.Once
+
+// master或者media playlist声明了EXT-X-INDEPENDENT-SEGMENTS，每个ts都可以单独解码，为1时从任意ts开始截取都不会花屏
+var independentSegments int32
+var independentWarning sync.Once
+
+// 音频ts文件保存的子目录
+const audioDir = "audio"
+
+const (
+	// ts包大小
+	tsPacketSize = 188
+	// ts包同步字节
+	tsSyncByte = 0x47
 )
 
 var bar *pb.ProgressBar
+
+// 进度条模板，在默认的计数和百分比后面显示下载速度和剩余时间
+const barTemplate = `{{counters . }} {{bar . }} {{percent . }} {{string . "speed"}} {{string . "eta"}}`
+
+// 本次运行下载的字节数和ts文件数，用于计算速度和剩余时间
+var downloadBytes int64
+var downloadCount int64
+
+// 已下载和总的ts时长，单位毫秒，用于按时长估算剩余时间
+var doneDuration int64
+var totalDuration int64
+
+// 抽样估算的码率，每秒视频的字节数
+var sampledBitrate float64
+
+// 下载失败的ts文件数和正在下载的协程数
+var failedCount int64
+var activeCount int64
+
+// 返回404下载失败的ts文件数
+var notFoundCount int64
+var startTime time.Time
 var downloadProcess = &DownloadProcess{}
+
+// 调试日志，只写入日志文件
+var debugLog = log.New(ioutil.Discard, "DEBUG ", log.LstdFlags)
 var UserAgent string
 var client = &http.Client{}
 
@@ -66,30 +315,351 @@ func Execute() {
 }
 
 func init() {
+	// 从配置文件读取参数，命令行指定的参数优先
+	rootCmd.Flags().StringVarP(&configFile, "config", "", "", "read options from a yaml, json or toml file, keys are the long flag names, command line flags win")
 	// 并行线程数，默认10个
 	rootCmd.Flags().IntVarP(&parallel, "num", "n", 10, "concurrent channel num")
 	// 下载m3u8链接
 	rootCmd.Flags().StringVarP(&m3u8Url, "url", "u", "", "m3u8 url to download video")
 	// 输出目录
 	rootCmd.Flags().StringVarP(&outPath, "out", "o", "", "the download output file path")
+	// 每秒最多发起的ts请求数，默认0不限制
+	rootCmd.Flags().IntVarP(&maxRps, "max-rps", "", 0, "max segment requests started per second, 0 means unlimited")
+	// m3u8文件请求失败重试次数，默认3次
+	rootCmd.Flags().IntVarP(&playlistRetry, "playlist-retry", "", 3, "retry times when fetching the m3u8 playlist fails")
+	// ts文件按url路径保存到对应子目录
+	rootCmd.Flags().BoolVarP(&preservePaths, "preserve-paths", "", false, "keep the directory structure of segment urls under the output path")
+	// 校验下载的内容是否为ts数据
+	rootCmd.Flags().BoolVarP(&validateTs, "validate-ts", "", false, "check the mpeg-ts sync byte of each segment and mark non-ts content failed")
+	// 同时下载选中码率对应的音频
+	rootCmd.Flags().BoolVarP(&concurrentPlaylists, "concurrent-playlists", "", false, "download the alternate audio rendition concurrently with the video")
+	// prometheus监控地址，例如 :9090
+	rootCmd.Flags().StringVarP(&metricsAddr, "metrics-addr", "", "", "expose prometheus metrics on this address, e.g. :9090")
+	// 抽样请求几个ts文件估算总大小和剩余时间，默认0不抽样
+	rootCmd.Flags().IntVarP(&sizeSamples, "size-samples", "", 0, "number of segments sampled across the playlist to estimate total size")
+	// 合并文件已存在时不覆盖
+	rootCmd.Flags().BoolVarP(&noClobber, "no-clobber", "", false, "abort instead of overwriting an existing merged output file")
+	// 指定域名解析，可以多个
+	rootCmd.Flags().StringArrayVarP(&resolveHosts, "resolve", "", nil, "resolve host:port to ip, like curl, e.g. example.com:443:127.0.0.1")
+	// ts文件名去掉url参数，请求时仍使用完整链接
+	rootCmd.Flags().BoolVarP(&stripQuery, "strip-query", "", true, "name segment files by url path only, without the query string")
+	// 日志文件，包含每个ts的下载信息
+	rootCmd.Flags().StringVarP(&logFile, "log-file", "", "", "also write logs to this file, with per-segment debug lines")
+	// 单个ts文件最大字节数，默认1G
+	rootCmd.Flags().Int64VarP(&maxSegmentSize, "max-segment-size", "", 1<<30, "max bytes of a single segment, larger segments are discarded and marked failed")
+	// 从第几个ts开始下载，之前的跳过，用于接着已有的存档继续下载
+	rootCmd.Flags().IntVarP(&startSegment, "start-segment", "", 0, "index of the first segment to download, starting from 0, earlier segments are skipped")
+	// 从哪个媒体序列号开始下载
+	rootCmd.Flags().Uint64VarP(&startSeq, "start-seq", "", 0, "media sequence number of the first segment to download, earlier segments are skipped")
+	// ts文件连接失败或服务器错误的重试次数，默认3次
+	rootCmd.Flags().IntVarP(&segmentRetry, "segment-retry", "", 3, "retry times of a segment on connection errors and server errors")
+	// 进度额外导出的格式，csv或者txt
+	rootCmd.Flags().StringVarP(&stateExport, "state-export", "", "", "also export segment status next to .index, csv or txt")
+	// 统计请求各阶段耗时和连接复用率
+	rootCmd.Flags().BoolVarP(&traceRequests, "trace", "", false, "record dns, connect, tls and first byte timings and print a summary")
+	// 只下载开始位置之后的一段时长，例如 5m
+	rootCmd.Flags().DurationVarP(&maxDuration, "duration", "", 0, "only download this much video from the start position, e.g. 5m")
+	// 合并时每隔几个ts刷新到磁盘，0为只在最后刷新
+	rootCmd.Flags().IntVarP(&mergeSync, "merge-sync", "", 100, "sync the merged file to disk every this many segments, 0 means only at the end")
+	// 以json输出master playlist的所有码率和音频字幕后退出
+	rootCmd.Flags().BoolVarP(&onlyVariants, "only-variants", "", false, "print all variants and renditions of a master playlist as json and exit")
+	// 每次发起ts请求前随机延时，降低被识别为爬虫的概率，会降低下载速度
+	rootCmd.Flags().StringVarP(&pace, "pace", "", "", "random delay range before each segment request, e.g. 200ms-2s, slower but less like a scraper")
+	// 合并文件按大小或者ts个数分成多个文件，例如 500M
+	rootCmd.Flags().StringVarP(&splitSize, "split-size", "", "", "split the merged output into parts of at most this size at segment edges, e.g. 500M")
+	// 合并文件每隔几个ts分成一个文件
+	rootCmd.Flags().IntVarP(&splitCount, "split-count", "", 0, "split the merged output into parts of this many segments")
+	// 允许不安全的tls加密套件和tls 1.0，兼容老旧的服务器
+	rootCmd.Flags().BoolVarP(&allowInsecureCiphers, "allow-insecure-ciphers", "", false, "enable insecure tls cipher suites and tls 1.0 for legacy servers")
+	// 下载master playlist的所有码率，每个码率一个子目录，并生成本地的master playlist
+	rootCmd.Flags().BoolVarP(&allVariants, "all-variants", "", false, "download every variant of a master playlist into its own subdirectory and write a local master playlist")
+	// 合并时跳过读取失败的ts，默认中止合并
+	rootCmd.Flags().BoolVarP(&allowGaps, "allow-gaps", "", false, "skip unreadable segments when merging instead of aborting")
+	// 双向认证的客户端证书和私钥，pem格式
+	rootCmd.Flags().StringVarP(&clientCert, "client-cert", "", "", "pem client certificate for mutual tls, used with --client-key")
+	rootCmd.Flags().StringVarP(&clientKey, "client-key", "", "", "pem private key of --client-cert")
+	// ts文件下载到临时目录，输出路径只保留合并后的文件
+	rootCmd.Flags().BoolVarP(&flat, "flat", "", false, "download segments into a temp directory and only write the merged file to the output path")
+	// 进度条按ts个数还是字节数显示，字节范围的大文件用bytes更平滑
+	rootCmd.Flags().StringVarP(&progressMode, "progress", "", "segments", "progress bar unit, segments or bytes")
+	// 允许最多几个ts返回404，跳过这些ts继续合并，默认有失败的ts时不合并
+	rootCmd.Flags().IntVarP(&keepGoing, "keep-going", "", 0, "tolerate up to this many segments returning 404 and merge without them")
+	// 创建的文件和目录的权限，八进制
+	rootCmd.Flags().StringVarP(&fileModeFlag, "file-mode", "", "0644", "permissions of created files in octal, masked by umask")
+	rootCmd.Flags().StringVarP(&dirModeFlag, "dir-mode", "", "0755", "permissions of created directories in octal, masked by umask")
+	// 缓存m3u8的有效期，有效期内重复运行不再请求m3u8，默认0不缓存
+	rootCmd.Flags().DurationVarP(&manifestCache, "manifest-cache", "", 0, "cache fetched vod manifests on disk and reuse them for this long, e.g. 1h")
+	// 忽略并且不更新m3u8缓存
+	rootCmd.Flags().BoolVarP(&noManifestCache, "no-manifest-cache", "", false, "bypass the manifest cache for this run")
+	// 多网卡时指定出口ip或者网卡
+	rootCmd.Flags().StringVarP(&localAddr, "local-addr", "", "", "bind outgoing connections to this local ip")
+	rootCmd.Flags().StringVarP(&netInterface, "interface", "", "", "bind outgoing connections to the ip of this network interface")
+	// ts返回403时调用的命令，参数为原链接，输出新的签名链接，默认重新获取m3u8
+	rootCmd.Flags().StringVarP(&segmentUrlTransform, "segment-url-transform", "", "", "command run with a segment url that returned 403, printing a re-signed url; by default the playlist is fetched again")
+	// 错误以json格式输出到stderr，方便其它程序解析
+	rootCmd.Flags().BoolVarP(&jsonErrors, "json-errors", "", false, "write fatal errors and segment failures to stderr as json lines")
+	// 最多下载几个ts，默认0不限制
+	rootCmd.Flags().IntVarP(&maxSegments, "max-segments", "", 0, "only download this many segments, 0 means unlimited")
+	// 选择最小带宽的码率，只下载前几个ts，用于快速检查能否下载
+	rootCmd.Flags().BoolVarP(&preview, "preview", "", false, "download the first segments of the lowest-bandwidth variant to check the stream works")
+	// 下载完成后在输出目录生成引用本地ts的index.m3u8
+	rootCmd.Flags().BoolVarP(&writeLocal, "write-local-playlist", "", false, "write an index.m3u8 referencing the downloaded segments into the output path")
+	// 下载完成后另外的协程重新读取ts校验，损坏的ts删除后标记失败
+	rootCmd.Flags().BoolVarP(&verifySegments, "verify", "", false, "re-read each segment after download to check its checksum and mpeg-ts packets, corrupt segments are marked failed")
+	// 按EXT-X-PROGRAM-DATE-TIME的时间截取，RFC3339格式，例如 2022-07-15T20:00:00+08:00
+	rootCmd.Flags().StringVarP(&startTimeFlag, "start-time", "", "", "skip segments ending before this program date time, rfc3339, e.g. 2022-07-15T20:00:00+08:00")
+	rootCmd.Flags().StringVarP(&endTimeFlag, "end-time", "", "", "skip segments starting at or after this program date time, rfc3339")
+	// 下载队列的长度，默认0时断点续传按ts个数，新下载为1024
+	rootCmd.Flags().IntVarP(&queueSize, "queue-size", "", 0, "buffer size of the segment queue, 0 means sized by the segment count when resuming and 1024 for a new download")
+	// 每个m3u8和ts请求都追加的url参数，可以多个，例如 token=abc
+	rootCmd.Flags().StringArrayVarP(&queryFlags, "query", "", nil, "query parameter key=value added to every request url, existing parameters are kept")
+	// m3u8文件的大小上限，防止恶意的超大m3u8耗尽内存
+	rootCmd.Flags().StringVarP(&maxPlaylistSize, "max-playlist-size", "", "50M", "maximum size of a playlist response, e.g. 50M")
+	// 视频和单独的音轨下载后用ffmpeg合并
+	rootCmd.Flags().BoolVarP(&mux, "mux", "", false, "mux the video and the separate audio track into one mp4 with ffmpeg")
+	// 全部下载一遍后再重试失败的ts
+	rootCmd.Flags().IntVarP(&retryFailed, "retry-failed", "", 1, "rounds of retrying the failed segments after all segments are attempted, 0 to disable")
+	// 输出目录是较慢的网络存储时，ts先写入本地的临时目录
+	rootCmd.Flags().StringVarP(&tempDir, "temp-dir", "", "", "write segments to .part files in this directory and move them to the output directory when complete")
+	// 跳过EXT-X-DATERANGE标记的广告
+	rootCmd.Flags().BoolVarP(&skipAds, "skip-ads", "", false, "skip segments inside EXT-X-DATERANGE SCTE-35 ad breaks")
+	// CDN返回过期的m3u8时使用
+	rootCmd.Flags().BoolVarP(&noCache, "no-cache", "", false, "send Cache-Control: no-cache and Pragma: no-cache with playlist requests and skip the local manifest cache")
+	// 每个ts的下载耗时写入csv，用于分析CDN性能
+	rootCmd.Flags().StringVarP(&timingCsv, "timing-csv", "", "", "append the start time, duration, bytes and throughput of each segment to this csv file")
+	// 断点续传时原来的m3u8链接已经过期，使用新获取的链接
+	rootCmd.Flags().StringVarP(&refreshUrl, "refresh-url", "", "", "fresh playlist url used when resuming after the original url expired")
+	// 按流量计费时分多次下载
+	rootCmd.Flags().StringVarP(&stopAfterBytes, "stop-after-bytes", "", "", "save the state and stop after downloading this many bytes in this run, e.g. 2G")
+	// 合并ts时修正连续计数
+	rootCmd.Flags().BoolVarP(&fixContinuity, "fix-continuity", "", false, "rewrite the mpeg-ts continuity counters when merging .ts segments")
+	// 边下载边合并，最后一个ts下载完成时合并也基本完成
+	rootCmd.Flags().BoolVarP(&concurrentMerge, "concurrent-merge", "", false, "append completed segments to the merged file in order while downloading")
+	// ts压缩保存，合并时自动解压
+	rootCmd.Flags().BoolVarP(&compressSegments, "compress-segments", "", false, "store the segment files gzip compressed, they are decompressed when merging")
+	// 合并文件的名字，ts和进度文件仍然在-o目录
+	rootCmd.Flags().StringVarP(&outputName, "name", "", "", "path of the merged file, the segments and the resume state stay in the output directory")
+	// 扩展名判断错误时指定合并文件的扩展名
+	rootCmd.Flags().StringVarP(&forceExt, "ext", "", "", "extension of the merged file instead of the detected one, e.g. mp4, only renames and does not remux")
+	// 自定义请求头，覆盖默认的Accept、User-Agent等
+	rootCmd.Flags().StringArrayVarP(&headerFlags, "header", "H", nil, "header \"Name: value\" added to every request, overrides the default headers")
+	// 保存请求到的原始m3u8，用于排查解析问题
+	rootCmd.Flags().BoolVarP(&dumpPlaylist, "dump-playlist", "", false, "save the raw fetched playlists to the output directory with the resolved url in a .url file")
+	// m3u8和ts的鉴权不同时，只用于m3u8请求的请求头
+	rootCmd.Flags().StringArrayVarP(&playlistHeaderFlags, "playlist-header", "", nil, "header \"Name: value\" added only to playlist requests, overrides --header")
+	// 每个下载协程使用单独的http客户端和连接池
+	rootCmd.Flags().BoolVarP(&clientPerWorker, "client-per-worker", "", false, "give each download worker its own http client and connection pool")
+	// 下载结束后以json输出汇总，或者写入文件
+	rootCmd.Flags().BoolVarP(&jsonSummary, "json-summary", "", false, "print a json summary of the download to stdout at the end")
+	rootCmd.Flags().StringVarP(&summaryFile, "summary-file", "", "", "write the json summary of the download to this file")
+	// 使用其它位置的.index继续下载，例如ts文件已经移动到新的输出目录
+	rootCmd.Flags().StringVarP(&stateFile, "state-file", "", "", "resume from this .index, with the segment files moved to the output path")
+	// 每个请求随机使用一个User-Agent，默认使用内置的列表
+	rootCmd.Flags().BoolVarP(&rotateUserAgent, "user-agent-rotate", "", false, "use a random user agent from a built-in pool for each request")
+	// User-Agent列表文件，每行一个，指定后自动开启轮换
+	rootCmd.Flags().StringVarP(&userAgentFile, "ua-file", "", "", "rotate user agents from this file, one per line")
+	// 同一码率有多个镜像链接时，测速选择最快的
+	rootCmd.Flags().BoolVarP(&probeMirrors, "probe-mirrors", "", false, "probe variants of the chosen quality on different hosts concurrently and use the fastest")
+	// 任意一个ts重试后仍然失败时保存进度并立即退出
+	rootCmd.Flags().BoolVarP(&failFast, "fail-fast", "", false, "save the progress and exit non-zero as soon as any segment fails after retries")
+	// 去重缓存的长度，默认0时点播不限制，直播按m3u8的ts个数
+	rootCmd.Flags().IntVarP(&dedupCacheSize, "dedup-cache-size", "", 0, "max segment urls remembered to skip duplicates, 0 means unlimited for vod and sized by the window for live")
+	// 在整个视频中均匀选择几个ts下载，用于生成缩略图，合并后不能连续播放
+	rootCmd.Flags().IntVarP(&sampleSegments, "sample", "", 0, "only download this many evenly spaced segments across the playlist, e.g. for thumbnails")
+	// 下载master playlist中的I帧列表
+	rootCmd.Flags().BoolVarP(&iframesOnly, "iframes", "", false, "download the I-frame playlist of a master playlist if present, e.g. for thumbnails")
+	// 断点续传时哪些ts重新下载
+	rootCmd.Flags().StringVarP(&resumePolicy, "resume-policy", "", "reuse-all", "which segments to fetch again on resume: reuse-all, reverify-failed, redownload-failed or redownload-all")
+	// 输出每个请求的请求头和响应头，用于排查403等问题
+	rootCmd.Flags().BoolVarP(&debugHTTP, "debug-http", "", false, "log the headers of every request and response")
+	// 输出时隐藏Cookie、Authorization等敏感的值
+	rootCmd.Flags().BoolVarP(&debugHTTPRedact, "debug-http-redact", "", false, "hide cookie and authorization values in --debug-http output")
+	// 每完成N%的ts保存一次进度
+	rootCmd.Flags().IntVarP(&checkpointPercent, "checkpoint-percent", "", 0, "save the resume state every N percent of segments completed, 0 to disable")
+	// 边下载边输出时按位置优先下载
+	rootCmd.Flags().StringVarP(&downloadOrder, "order", "", "any", "segment download order: any for maximum throughput, in-order to prefer the earliest unfinished segment")
+	// 直播超过这么久没有新的ts时认为已经结束，0为一直轮询到出现结束标签
+	rootCmd.Flags().DurationVarP(&liveIdleTimeout, "live-idle-timeout", "", 0, "stop polling a live playlist after no new segments for this long, e.g. 2m, 0 polls until ENDLIST")
 }
 
 func downloadFunc(cmd *cobra.Command, args []string) {
-	if m3u8Url == "" || outPath == "" {
-		fmt.Println("args miss, for example: ")
-		fmt.Println("m3u8load -u https://v2.szjal.cn/20191215/B6UVqUJm/index.m3u8 -o charles")
+	if m3u8Url == "" || (outPath == "" && !onlyVariants) {
 		cmd.Help()
-		os.Exit(1)
+		exitWithError(errors.New("args miss, for example: m3u8load -u https://v2.szjal.cn/20191215/B6UVqUJm/index.m3u8 -o charles"))
 	}
+	outPath = cleanOutPath(outPath)
 	if !strings.HasPrefix(m3u8Url, "http") || !strings.HasSuffix(m3u8Url, "m3u8") {
-		fmt.Println("m3u8 url illegal, for example: https://v2.szjal.cn/20191215/B6UVqUJm/index.m3u8 ")
 		cmd.Help()
-		os.Exit(1)
+		exitWithError(errors.New("m3u8 url illegal, for example: https://v2.szjal.cn/20191215/B6UVqUJm/index.m3u8"))
+	}
+	if _, _, err := parsePace(pace); err != nil {
+		exitWithError(err)
+	}
+	if mux {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			exitWithError(errors.New("--mux needs ffmpeg in PATH"))
+		}
+	}
+	if _, err := parseSize(splitSize); err != nil {
+		exitWithError(err)
+	}
+	if splitCount < 0 {
+		exitWithError(errors.New("split count must not be negative"))
+	}
+	var err error
+	if maxPlaylistBytes, err = parseSize(maxPlaylistSize); err != nil || maxPlaylistBytes == 0 {
+		exitWithError(errors.New("max playlist size must be a size, for example: 50M"))
+	}
+	if stopAfter, err = parseSize(stopAfterBytes); err != nil {
+		exitWithError(err)
+	}
+	if fileMode, err = parseMode(fileModeFlag); err != nil {
+		exitWithError(err)
+	}
+	if dirMode, err = parseMode(dirModeFlag); err != nil {
+		exitWithError(err)
+	}
+	if startTimeFlag != "" {
+		if clipStart, err = time.Parse(time.RFC3339, startTimeFlag); err != nil {
+			exitWithError(fmt.Errorf("start time %q illegal, for example: 2022-07-15T20:00:00+08:00", startTimeFlag))
+		}
+	}
+	if endTimeFlag != "" {
+		if clipEnd, err = time.Parse(time.RFC3339, endTimeFlag); err != nil {
+			exitWithError(fmt.Errorf("end time %q illegal, for example: 2022-07-15T21:00:00+08:00", endTimeFlag))
+		}
+	}
+	if !clipStart.IsZero() && !clipEnd.IsZero() && !clipEnd.After(clipStart) {
+		exitWithError(errors.New("end time must be after start time"))
+	}
+	if queryParams, err = parseQueryParams(queryFlags); err != nil {
+		exitWithError(err)
+	}
+	if headers, err = parseHeaders(headerFlags); err != nil {
+		exitWithError(err)
+	}
+	if playlistHeaders, err = parseHeaders(playlistHeaderFlags); err != nil {
+		exitWithError(err)
+	}
+	switch resumePolicy {
+	case "reuse-all", "reverify-failed", "redownload-failed", "redownload-all":
+	default:
+		exitWithError(errors.New("resume policy must be reuse-all, reverify-failed, redownload-failed or redownload-all"))
+	}
+	if downloadOrder != "any" && downloadOrder != "in-order" {
+		exitWithError(errors.New("order must be any or in-order"))
+	}
+	if concurrentMerge && (noClobber || splitSize != "" || splitCount > 0 || allVariants) {
+		exitWithError(errors.New("--concurrent-merge can not be used with --no-clobber, --split-size, --split-count or --all-variants"))
+	}
+	// 边下载边合并时ts下载完成就写入，校验出错的ts已经在合并文件中
+	if concurrentMerge && verifySegments {
+		exitWithError(errors.New("--concurrent-merge can not be used with --verify, segments are merged before they are verified"))
+	}
+	if outputName != "" && allVariants {
+		exitWithError(errors.New("--name can not be used with --all-variants"))
+	}
+	if refreshUrl != "" && allVariants {
+		exitWithError(errors.New("--refresh-url can not be used with --all-variants"))
+	}
+	if timingCsv != "" {
+		if err := openTimingCsv(timingCsv); err != nil {
+			exitWithError(err)
+		}
+	}
+	if tempDir != "" {
+		if err := os.MkdirAll(tempDir, dirMode); err != nil {
+			exitWithError(err)
+		}
+	}
+	if retryFailed < 0 {
+		exitWithError(errors.New("retry failed rounds must not be negative"))
+	}
+	if checkpointPercent < 0 || checkpointPercent > 100 {
+		exitWithError(errors.New("checkpoint percent must be between 0 and 100"))
+	}
+	if queueSize < 0 {
+		exitWithError(errors.New("queue size must not be negative"))
+	}
+	if preview && maxSegments == 0 {
+		maxSegments = previewSegments
+	}
+	if progressMode != "segments" && progressMode != "bytes" {
+		exitWithError(errors.New("progress must be segments or bytes"))
+	}
+	if stateExport != "" && stateExport != "csv" && stateExport != "txt" {
+		exitWithError(errors.New("state export format must be csv or txt"))
+	}
+	// 并发数为0时下载协程无法启动，会一直阻塞
+	if parallel < 1 {
+		exitWithError(errors.New("concurrent num must be at least 1"))
+	}
+	if userAgentFile != "" {
+		if userAgents, err = loadUserAgents(userAgentFile); err != nil {
+			exitWithError(err)
+		}
+	} else if rotateUserAgent {
+		userAgents = defaultUserAgents
+	}
+	if stateFile != "" {
+		if _, err := os.Stat(stateFile); err != nil {
+			exitWithError(err)
+		}
+	}
+	// json错误输出时其它日志不写入stderr
+	if jsonErrors {
+		log.SetOutput(ioutil.Discard)
+	}
+	// 日志文件
+	if logFile != "" {
+		if err := setupLogFile(logFile); err != nil {
+			exitWithError(err)
+		}
+	}
+	// http客户端配置
+	if err := setupClient(); err != nil {
+		exitWithError(err)
+	}
+	// 只列出所有码率和音频字幕，不下载
+	if onlyVariants {
+		listVariants(m3u8Url)
+		os.Exit(0)
+	}
+	// 合并文件的路径，不带扩展名，--name时和ts目录分开
+	mergePath := outPath
+	if outputName != "" {
+		mergePath = filepath.Clean(outputName)
+		// 带扩展名时按指定的扩展名输出
+		if ext := filepath.Ext(mergePath); ext != "" {
+			mergePath = strings.TrimSuffix(mergePath, ext)
+			if forceExt == "" {
+				forceExt = ext
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(mergePath), dirMode); err != nil {
+			exitWithError(err)
+		}
+	}
+	// 已有合并文件时不覆盖，直接退出，扩展名由ts决定时合并前还会再检查
+	if _, err := os.Stat(mergePath + mergeExtension()); err == nil && noClobber {
+		exitWithError(fmt.Errorf("output file %s already exists, remove it or run without --no-clobber", mergePath+mergeExtension()))
+	}
+	if flat {
+		if allVariants {
+			exitWithError(errors.New("--flat can not be used with --all-variants"))
+		}
+		if writeLocal {
+			exitWithError(errors.New("--flat can not be used with --write-local-playlist, the segments are removed after merging"))
+		}
+		outPath = flatPath(outPath)
 	}
 	fmt.Println("")
 	fmt.Println("concurrent num : " + strconv.Itoa(parallel))
 	fmt.Println("m3u8 url: " + m3u8Url)
-	fmt.Println("output file path: " + outPath)
+	fmt.Println("output file path: " + mergePath)
+	if flat {
+		fmt.Println("segment path: " + outPath)
+	}
 	fmt.Println("")
 
 	// defer 在资源释放、连接关闭、函数结束时调用
@@ -99,41 +669,236 @@ func downloadFunc(cmd *cobra.Command, args []string) {
 	// 退出的钩子
 	go listenSignal()
 
+	// 监控指标
+	if metricsAddr != "" {
+		startMetrics(metricsAddr)
+	}
+
+	// 下载所有码率，每个码率单独断点续传和合并
+	if allVariants {
+		if err := downloadAllVariants(m3u8Url); errors.Is(err, errBudgetReached) {
+			exitForBudget()
+		} else if err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	// 合并文件是命名管道时边下载边写入
+	// --concurrent-merge时边下载边合并
+	var stream *pipeStream
+	if pipeName, ok := namedPipeOutput(mergePath); ok {
+		if verifySegments {
+			exitWithError(errors.New("--verify can not be used with a named pipe output, segments are streamed before they are verified"))
+		}
+		stream = startPipeStream(outPath, pipeName)
+	} else if concurrentMerge {
+		stream = startMergeStream(outPath, mergePath)
+	}
+
+	downloadPlaylist(m3u8Url, outPath)
+
+	finishBar()
+	if budgetReached() {
+		exitForBudget()
+	}
+	if stream != nil {
+		stream.wait()
+	}
+	fmt.Println("")
+	// 生成引用本地ts的m3u8，不合并也可以直接播放
+	if writeLocal {
+		if err := writeLocalPlaylist(outPath); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("local playlist: " + filepath.Join(outPath, localMediaName))
+	}
+	// 写入进度和合并ts文件
+	if err := writeAndMergeFile(outPath, mergePath); err != nil {
+		writeSummary(mergePath, err)
+		exitWithError(err)
+	}
+	if mux {
+		if err := muxAudio(mergePath); err != nil {
+			writeSummary(mergePath, err)
+			exitWithError(err)
+		}
+	}
+	writeSummary(mergePath, nil)
+	if preview {
+		fmt.Println("preview saved to " + mergePath + mergeExtension())
+	}
+	// 全部下载成功后删除临时目录，有失败的ts时保留用于断点续传
+	if flat && atomic.LoadInt64(&failedCount) == 0 {
+		if err := os.RemoveAll(outPath); err != nil {
+			fmt.Println(err)
+		}
+	}
+	// 请求耗时统计
+	if traceRequests {
+		requestTrace.print()
+	}
+	// 应用正常退出
+	os.Exit(0)
+}
+
+// 去掉末尾和重复的分隔符，否则合并文件会变成 videos/.ts
+func cleanOutPath(p string) string {
+	if p == "" {
+		return p
+	}
+	return filepath.Clean(p)
+}
+
+// 下载m3u8到outPath，存在进度文件时断点续传
+func downloadPlaylist(urlStr string, outPath string) {
+	downloadProcess.Lock()
+	downloadProcess.dir = outPath
+	// 旧的进度文件没有记录时按这次的参数
+	downloadProcess.Compressed = compressSegments
+	downloadProcess.Unlock()
 	name := outPath + string(os.PathSeparator) + ".index"
+	// 使用其它位置的进度文件，ts文件已经移动到输出目录
+	if stateFile != "" {
+		name = stateFile
+	}
 	if _, err := os.Stat(name); os.IsNotExist(err) {
 		// 1、下载新文件
-		msChan := make(chan *Download, 1024)
-		go getPlaylist(m3u8Url, msChan)
+		msChan := make(chan *Download, downloadQueueSize(0))
+		go getPlaylist(urlStr, msChan)
 
 		// 并发下载ts文件, 文件输出目录，默认当前文件
 		downloadSegmentLimit(outPath, msChan)
 	} else {
 		// 2、已存在已有文件
 		load(name, downloadProcess)
+		if downloadProcess.Compressed != compressSegments {
+			exitWithError(fmt.Errorf("segments in %s were saved with compress-segments=%v, rerun with the same option", outPath, downloadProcess.Compressed))
+		}
+		checkSegmentFiles(outPath)
+		applyResumePolicy(outPath)
+		// 原来的m3u8链接过期时，使用新的链接继续下载
+		if refreshUrl != "" && len(downloadProcess.MediaList) > 0 {
+			if err := applyRefreshUrl(refreshUrl); err != nil {
+				exitWithError(err)
+			}
+		}
 		if len(downloadProcess.MediaList) > 0 {
-			msChan := make(chan *Download, 1024)
+			msChan := make(chan *Download, downloadQueueSize(len(downloadProcess.MediaList)+len(downloadProcess.AudioList)))
 
-			// 异步继续下载未完成的ts
-			go getContinuePlaylist(msChan)
+			// 异步继续下载未完成的ts，直播还要继续轮询新的ts
+			if downloadProcess.Live && downloadProcess.MediaUrl != "" {
+				go getContinueLive(msChan)
+			} else {
+				go getContinuePlaylist(msChan)
+			}
 
 			// 并发下载ts文件, 文件输出目录，默认当前文件
 			downloadSegmentLimit(outPath, msChan)
 		} else {
-			// 文件不完整，重新下载
-			msChan := make(chan *Download, 1024)
-			go getPlaylist(m3u8Url, msChan)
+			// 文件不完整，重新下载，优先使用上次选中的码率链接
+			playlistUrl := urlStr
+			if refreshUrl != "" {
+				playlistUrl = refreshUrl
+			} else if downloadProcess.MediaUrl != "" {
+				playlistUrl = downloadProcess.MediaUrl
+			}
+			msChan := make(chan *Download, downloadQueueSize(0))
+			if downloadProcess.AudioUrl != "" {
+				go getRenditions(playlistUrl, downloadProcess.AudioUrl, msChan)
+			} else {
+				go getPlaylist(playlistUrl, msChan)
+			}
 
 			// 并发下载ts文件, 文件输出目录，默认当前文件
 			downloadSegmentLimit(outPath, msChan)
 		}
 	}
+	// 最后只重试失败的ts
+	retryFailedSegments(outPath)
+}
 
-	bar.Finish()
-	fmt.Println("")
-	// 写入进度和合并ts文件
-	writeAndMergeFile(outPath)
-	// 应用正常退出
-	os.Exit(0)
+// 下载队列的长度，断点续传时按ts个数，最多65536
+// 新下载时队列在解析m3u8之前创建，不知道个数，固定为1024，只有--queue-size能调整
+func downloadQueueSize(count int) int {
+	if queueSize > 0 {
+		return queueSize
+	}
+	if count <= 0 {
+		return defaultQueueSize
+	}
+	if count > maxQueueSize {
+		return maxQueueSize
+	}
+	return count
+}
+
+// 断点续传时检查已完成的ts文件是否还在输出目录，不在的重新下载
+func checkSegmentFiles(outPath string) {
+	missing := 0
+	for name, done := range downloadProcess.MediaStatus {
+		if !done {
+			continue
+		}
+		if size, err := DownloadOptions.statFile(filepath.Join(outPath, filepath.FromSlash(name))); err != nil || size == 0 {
+			downloadProcess.MediaStatus[name] = false
+			missing++
+		}
+	}
+	if missing > 0 {
+		fmt.Printf("%d completed segments not found in %s, download them again\n", missing, outPath)
+	}
+}
+
+// 断点续传时按--resume-policy决定哪些ts重新下载
+func applyResumePolicy(outPath string) {
+	if resumePolicy == "reuse-all" {
+		return
+	}
+	changed := 0
+	for _, name := range append(append([]string{}, downloadProcess.MediaList...), downloadProcess.AudioList...) {
+		done := downloadProcess.MediaStatus[name]
+		switch resumePolicy {
+		case "reverify-failed":
+			// 失败的ts没有记录sha256，只有记录了字节数并且文件大小一致、是完整的ts包时直接使用
+			// 没有Content-Length的ts无法判断是否被截断，仍然重新下载
+			size, ok := downloadProcess.Sizes[name]
+			if !done && ok && size > 0 && wholeTsSize(filepath.Join(outPath, filepath.FromSlash(name))) == size {
+				downloadProcess.MediaStatus[name] = true
+				changed++
+			}
+		case "redownload-failed":
+			// 已完成的ts校验不通过时和失败的ts一起重新下载
+			if done && verifySegment(outPath, &Download{Name: name}) != nil {
+				downloadProcess.MediaStatus[name] = false
+				changed++
+			}
+		case "redownload-all":
+			if done {
+				downloadProcess.MediaStatus[name] = false
+				changed++
+			}
+		}
+	}
+	fmt.Printf("resume policy %s changed the status of %d segments\n", resumePolicy, changed)
+}
+
+// 文件以同步字节开始并且长度为ts包的整数倍时返回字节数，压缩保存的按解压后的长度，不是完整的ts时返回-1
+func wholeTsSize(name string) int64 {
+	f, err := DownloadOptions.openSegment(name)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if !isTsData(br) {
+		return -1
+	}
+	size, err := io.Copy(ioutil.Discard, br)
+	if err != nil || size <= 0 || size%tsPacketSize != 0 {
+		return -1
+	}
+	return size
 }
 
 // 异常捕获处理
@@ -142,13 +907,33 @@ func catchException() {
 	// 获取异常
 	err := recover()
 	if err != nil {
-		fmt.Println("error msg: " + fmt.Sprintf("%s", err))
+		if jsonErrors {
+			writeErrorRecord("error", "", fmt.Errorf("%s", err))
+		} else {
+			fmt.Println("error msg: " + fmt.Sprintf("%s", err))
+		}
 	}
 
 	// 任务进度
 	writeJsonFile()
 }
 
+// 日志同时写入文件，调试日志只写入文件，进度条仍然输出到终端
+func setupLogFile(name string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	// json错误输出时stderr只输出json
+	if jsonErrors {
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(io.MultiWriter(os.Stderr, f))
+	}
+	debugLog.SetOutput(f)
+	return nil
+}
+
 func load(filename string, v interface{}) {
 	//ReadFile函数会读取文件的全部内容，并将结果以[]byte类型返回
 	data, err := ioutil.ReadFile(filename)
@@ -164,9 +949,197 @@ func load(filename string, v interface{}) {
 }
 
 func doRequest(c *http.Client, req *http.Request) (*http.Response, error) {
-	req.Header.Set("User-Agent", UserAgent)
+	return doRequestWith(c, req, nil)
+}
+
+// m3u8请求还要加上--playlist-header，覆盖--header中的同名请求头
+func doPlaylistRequest(c *http.Client, req *http.Request) (*http.Response, error) {
+	return doRequestWith(c, req, playlistHeaders)
+}
+
+func doRequestWith(c *http.Client, req *http.Request, extra http.Header) (*http.Response, error) {
+	req.Header.Set("User-Agent", pickUserAgent())
+	addQueryParams(req.URL)
+	// 手动协商压缩方式，同时支持gzip和brotli，范围请求不压缩
+	if req.Header.Get("Range") == "" {
+		req.Header.Set("Accept-Encoding", "gzip, br")
+	}
+	setHeaders(req, headers)
+	setHeaders(req, extra)
+	if traceRequests {
+		req = withTrace(req)
+	}
+	dumpRequest(req)
 	resp, err := c.Do(req)
-	return resp, err
+	if err != nil {
+		return resp, err
+	}
+	dumpResponse(resp)
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// 在请求链接上追加--query参数，链接中已有的参数保持不变，不改变原有参数的顺序，防止签名失效
+func addQueryParams(u *url.URL) {
+	if len(queryParams) == 0 {
+		return
+	}
+	existing := u.Query()
+	extra := url.Values{}
+	for _, p := range queryParams {
+		if _, ok := existing[p.key]; !ok {
+			extra.Add(p.key, p.value)
+		}
+	}
+	if len(extra) == 0 {
+		return
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = extra.Encode()
+	} else {
+		u.RawQuery += "&" + extra.Encode()
+	}
+}
+
+// 解析key=value格式的参数
+func parseQueryParams(values []string) ([]queryParam, error) {
+	var params []queryParam
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("query %q illegal, for example: token=abc", value)
+		}
+		params = append(params, queryParam{parts[0], parts[1]})
+	}
+	return params, nil
+}
+
+// --header解析后的请求头，--playlist-header只用于m3u8请求
+var headers, playlistHeaders http.Header
+
+// 解析 Name: value 格式的请求头，同名的请求头可以有多个
+func parseHeaders(values []string) (http.Header, error) {
+	h := http.Header{}
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("header %q illegal, for example: Referer: https://example.com/", value)
+		}
+		h.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return h, nil
+}
+
+// 自定义请求头覆盖默认值，Host需要单独设置
+func setHeaders(req *http.Request, h http.Header) {
+	for key, values := range h {
+		if key == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[key] = values
+	}
+}
+
+// 解压后的响应，关闭时同时关闭原始响应
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (d *decodedBody) Close() error {
+	if c, ok := d.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return d.body.Close()
+}
+
+// 根据Content-Encoding解压响应，解压后的长度未知
+func decodeBody(resp *http.Response) error {
+	// HEAD、304和204没有内容，HEAD保留压缩后的Content-Length，估算大小时使用
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent || resp.ContentLength == 0 {
+		return nil
+	}
+	var reader io.Reader
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		reader = gr
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	resp.Body = &decodedBody{Reader: reader, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// 解析随机延时范围，格式 min-max，例如 200ms-2s
+func parsePace(value string) (time.Duration, time.Duration, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("pace %q illegal, for example: 200ms-2s", value)
+	}
+	min, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("pace %q illegal, max must not be less than min", value)
+	}
+	return min, max, nil
+}
+
+// 解析八进制的文件权限，例如 0644
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("mode %q illegal, for example: 0644", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// 失败后按指数退避重试，最多重试times次
+func retry(times int, fn func() error) error {
+	return retryIf(times, fn, func(error) bool {
+		return true
+	})
+}
+
+// 第一次重试前的等待时间，之后每次翻倍
+var retryWait = time.Second
+
+// 同retry，只重试retryable返回true的错误
+func retryIf(times int, fn func() error, retryable func(error) bool) error {
+	wait := retryWait
+	err := fn()
+	for i := 0; i < times && err != nil && retryable(err); i++ {
+		log.Printf("retry %d/%d after %v: %v\n", i+1, times, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+		err = fn()
+	}
+	return err
 }
 
 // 并发限制
@@ -176,7 +1149,7 @@ func downloadSegmentLimit(outPath string, dlc chan *Download) {
 	// 目录不存在创建目录
 	_, err := os.Stat(outPath)
 	if os.IsNotExist(err) {
-		err := os.Mkdir(outPath, os.ModePerm)
+		err := os.MkdirAll(outPath, dirMode)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -185,9 +1158,44 @@ func downloadSegmentLimit(outPath string, dlc chan *Download) {
 	// 5个并发
 	chLimit := make(chan bool, parallel)
 	wg := sync.WaitGroup{}
+	// 记录下载队列，用于监控队列长度
+	downloadQueue.Store(dlc)
+	// 下载完成的ts另外校验
+	startVerifiers(outPath)
+
+	// 请求频率限制，所有协程共享
+	limiter := newRateLimiter(maxRps)
 
-	for v := range dlc {
+	// 请求间隔随机延时
+	paceMin, paceMax, err := parsePace(pace)
+	if err != nil {
+		log.Panic(err)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	// 按位置优先下载时，先占用下载协程再取ts，保证取到的是当时最靠前的
+	if downloadOrder == "in-order" {
+		dlc = orderedQueue(dlc)
+	}
+	for {
 		chLimit <- true
+		// 达到--stop-after-bytes时不再取新的ts，等待正在下载的ts结束
+		var v *Download
+		ok := false
+		if !budgetReached() {
+			select {
+			case v, ok = <-dlc:
+			case <-budgetStop:
+			}
+		}
+		if !ok || budgetReached() {
+			<-chLimit
+			break
+		}
+		if paceMax > 0 {
+			time.Sleep(paceMin + time.Duration(rand.Int63n(int64(paceMax-paceMin)+1)))
+		}
+		limiter.wait()
 		wg.Add(1)
 		// 并发下载
 		go downloadSegment(chLimit, &wg, outPath, v)
@@ -195,57 +1203,350 @@ func downloadSegmentLimit(outPath string, dlc chan *Download) {
 
 	close(chLimit)
 	wg.Wait()
+	stopVerifiers()
+}
+
+// 请求频率限制，保证相邻两个请求的间隔
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// 每秒最多rps个请求，0为不限制
+func newRateLimiter(rps int) *rateLimiter {
+	l := &rateLimiter{next: time.Now()}
+	if rps > 0 {
+		l.interval = time.Second / time.Duration(rps)
+	}
+	return l
+}
+
+// 距离上一个请求不到间隔时等待，只在分发ts的协程中调用
+func (l *rateLimiter) wait() {
+	if l.interval <= 0 {
+		return
+	}
+	if d := time.Until(l.next); d > 0 {
+		time.Sleep(d)
+	}
+	l.next = time.Now().Add(l.interval)
 }
 
 func downloadSegment(chLimit chan bool, wg *sync.WaitGroup, outPath string, v *Download) {
 	defer catchException()
+	// 失败提前返回时也要释放，否则wg.Wait会一直阻塞
+	defer func() {
+		wg.Done()
+		// 从channel读取数据
+		<-chLimit
+	}()
+	atomic.AddInt64(&activeCount, 1)
+	defer atomic.AddInt64(&activeCount, -1)
+
+	// data:链接直接解码写入文件
+	if strings.HasPrefix(v.URI, "data:") {
+		saveDataSegment(outPath, v)
+		return
+	}
 
 	index := strings.LastIndex(v.URI, "/")
 	if index != -1 {
 		// 已经成功下载直接跳过
-		_, ok := downloadProcess.status.Load(v.URI)
-		if ok == true {
+		done, ok := downloadProcess.status.Load(v.Name)
+		if ok && done.(bool) {
 			return
 		}
 
-		req, err := http.NewRequest("GET", string(v.URI), nil)
-		if err != nil {
-			log.Panic(err)
+		DownloadOptions.segmentStart(v.URI)
+		start := time.Now()
+		c := acquireClient()
+		defer releaseClient(c)
+		resp, err := requestSegment(c, v)
+		// 签名链接过期返回403时，获取新的链接重试一次
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusForbidden {
+			if uri, refreshErr := refreshSegmentUri(v); refreshErr != nil {
+				log.Printf("Refresh segment url failed for %v: %v\n", v.URI, refreshErr)
+			} else if uri != v.URI {
+				debugLog.Printf("segment %v refreshed to %v\n", v.URI, uri)
+				v.URI = uri
+				resp, err = requestSegment(c, v)
+			}
 		}
-		resp, err := doRequest(client, req)
 		if err != nil {
+			writeTiming(v, start, 0, "error")
 			log.Print(err)
-			setMediaStatus(v.URI, false)
+			failSegment(v, err)
 			return
 		}
-		if resp.StatusCode != 200 {
-			setMediaStatus(v.URI, false)
-			log.Printf("Received HTTP %v for %v\n", resp.StatusCode, v.URI)
-			return
+		logHostRedirect(v, resp)
+
+		// 读取中途断开时从断开的位置继续
+		resp.Body = newResumeBody(c, v, resp)
+		var body io.Reader = resp.Body
+		if v.Limit > 0 {
+			// 服务器不支持Range时返回整个文件，跳过前面的字节
+			if resp.StatusCode == 200 {
+				if _, err := io.CopyN(ioutil.Discard, resp.Body, v.Offset); err != nil {
+					resp.Body.Close()
+					log.Print(err)
+					failSegment(v, err)
+					return
+				}
+			}
+			body = io.LimitReader(resp.Body, v.Limit)
+		}
+		if validateTs {
+			// 校验是否为ts数据，防止返回200的错误页面被合并进去
+			br := bufio.NewReader(body)
+			if !isTsData(br) {
+				resp.Body.Close()
+				log.Printf("Not mpeg-ts data for %v\n", v.URI)
+				failSegment(v, errors.New("not mpeg-ts data"))
+				return
+			}
+			body = br
 		}
 
 		// 根据路径 + 文件.ts 拼接路径 （直接创建文件）
-		name := getFileName(v.URI)
-		out, _ := os.Create(outPath + "/" + name)
-		// ts文件写入到对应文件中
-		_, err = io.Copy(out, resp.Body)
+		fileName := filepath.Join(outPath, filepath.FromSlash(v.Name))
+		out, err := DownloadOptions.createSegment(fileName)
 		if err != nil {
-			log.Panic(err)
+			resp.Body.Close()
+			log.Printf("Create segment file failed for %v: %v\n", v.Name, err)
+			failSegment(v, err)
+			return
+		}
+		// 字节范围的ts入队时已经计入总字节数
+		if v.Limit == 0 {
+			addByteTotal(resp.ContentLength)
+			setSize(v.Name, resp.ContentLength)
+		} else {
+			setSize(v.Name, v.Limit)
+		}
+		// ts文件写入到对应文件中，限制大小防止异常响应写满磁盘，同时计算sha256
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(out, hash, byteProgress{}), io.LimitReader(body, maxSegmentSize+1))
+		if err != nil {
+			abortSegment(out)
+		} else {
+			err = out.Close()
 		}
 		resp.Body.Close()
+		if err != nil {
+			log.Printf("Write segment failed for %v: %v\n", v.Name, err)
+			failSegment(v, err)
+			return
+		}
+		// 没有Content-Length时下载完成后计入总字节数
+		if v.Limit == 0 && resp.ContentLength <= 0 {
+			addByteTotal(n)
+		}
+		if n > maxSegmentSize {
+			os.Remove(fileName)
+			log.Printf("Segment larger than %d bytes for %v\n", maxSegmentSize, v.URI)
+			failSegment(v, fmt.Errorf("segment larger than %d bytes", maxSegmentSize))
+			return
+		}
+
+		// 记录ts的Content-Type，用于判断合并文件扩展名，音频和视频分开
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			downloadProcess.Lock()
+			field := &downloadProcess.ContentType
+			if strings.HasPrefix(v.Name, audioDir+"/") {
+				field = &downloadProcess.AudioContentType
+			}
+			if *field == "" {
+				*field = contentType
+			}
+			downloadProcess.Unlock()
+		}
 
 		// 当前链接下载成功
-		setMediaStatus(v.URI, true)
+		setChecksum(v.Name, hex.EncodeToString(hash.Sum(nil)))
+		setMediaStatus(v.Name, true)
 		// 进度+1
+		atomic.AddInt64(&downloadBytes, n)
+		atomic.AddInt64(&downloadCount, 1)
+		atomic.AddInt64(&doneDuration, int64(v.Duration*1000))
 		bar.Increment()
+		checkpoint()
+		checkByteBudget()
+		updateSpeed()
+		debugLog.Printf("segment %v status %v bytes %d time %v\n", v.URI, resp.StatusCode, n, time.Since(start))
+		writeTiming(v, start, n, strconv.Itoa(resp.StatusCode))
+		DownloadOptions.segmentDone(v.URI, n)
+		queueVerify(v)
+	}
+}
+
+// 解码data:链接的内容写入ts文件
+func saveDataSegment(outPath string, v *Download) {
+	data, err := decodeDataUri(v.URI)
+	if err == nil {
+		fileName := filepath.Join(outPath, filepath.FromSlash(v.Name))
+		if err = os.MkdirAll(filepath.Dir(fileName), dirMode); err == nil {
+			err = ioutil.WriteFile(fileName, data, fileMode)
+		}
+	}
+	if err != nil {
+		log.Printf("Decode data uri failed for %v: %v\n", v.Name, err)
+		failSegment(v, err)
+		return
+	}
+
+	addByteTotal(int64(len(data)))
+	byteProgress{}.Write(data)
+	sum := sha256.Sum256(data)
+	setChecksum(v.Name, hex.EncodeToString(sum[:]))
+	setMediaStatus(v.Name, true)
+	atomic.AddInt64(&downloadCount, 1)
+	bar.Increment()
+	checkpoint()
+	DownloadOptions.segmentDone(v.URI, int64(len(data)))
+}
+
+// 解析data:链接，支持base64和url编码两种格式
+func decodeDataUri(uri string) ([]byte, error) {
+	comma := strings.Index(uri, ",")
+	if !strings.HasPrefix(uri, "data:") || comma == -1 {
+		return nil, errors.New("illegal data uri")
+	}
+	meta, data := uri[len("data:"):comma], uri[comma+1:]
+	if strings.HasSuffix(meta, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	s, err := url.PathUnescape(data)
+	return []byte(s), err
+}
+
+// 请求ts文件，连接错误和服务器错误重试，404等其它错误直接失败
+func requestSegment(c *http.Client, v *Download) (*http.Response, error) {
+	var resp *http.Response
+	err := retryIf(segmentRetry, func() error {
+		req, err := http.NewRequest("GET", string(v.URI), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", segmentAccept)
+		if v.Limit > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", v.Offset, v.Offset+v.Limit-1))
+		}
+		resp, err = doRequest(c, req)
+		if err != nil {
+			return err
+		}
+		// 206时字节范围的ts或者范围覆盖整个文件都是完整的内容
+		partial := resp.StatusCode == http.StatusPartialContent && (v.Limit > 0 || isFullContentRange(resp.Header.Get("Content-Range")))
+		if resp.StatusCode != 200 && !partial {
+			resp.Body.Close()
+			return &statusError{resp.StatusCode, v.URI}
+		}
+		return nil
+	}, isRetryable)
+	return resp, err
+}
+
+// Content-Range是否覆盖整个文件，例如 bytes 0-999/1000
+func isFullContentRange(value string) bool {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return false
+	}
+	return start == 0 && end == total-1
+}
+
+// http状态码错误
+type statusError struct {
+	code int
+	uri  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Received HTTP %v for %v", e.code, e.uri)
+}
+
+// 判断错误是否需要重试，DNS、超时、连接被重置等临时的连接层错误和5xx、429重试；
+// 连接被拒绝、TLS握手失败等重试也不会成功，不重试
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Timeout() || errors.Is(opErr, syscall.ECONNRESET) || errors.Is(opErr, syscall.EPIPE)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
 	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-	wg.Done()
-	// 从channel读取数据
-	<-chLimit
+// 校验ts同步字节，ts包每188字节以0x47开头，检查前两个包
+func isTsData(br *bufio.Reader) bool {
+	head, _ := br.Peek(tsPacketSize * 2)
+	if len(head) == 0 || head[0] != tsSyncByte {
+		return false
+	}
+	if len(head) > tsPacketSize && head[tsPacketSize] != tsSyncByte {
+		return false
+	}
+	return true
+}
+
+// 创建进度条并开始计时
+func startBar(total int) {
+	startProgress(total)
+	startTime = time.Now()
+}
+
+// 根据已下载的字节数更新速度，按平均ts大小估算剩余时间
+func updateSpeed() {
+	size := atomic.LoadInt64(&downloadBytes)
+	count := atomic.LoadInt64(&downloadCount)
+	elapsed := time.Since(startTime).Seconds()
+	if size <= 0 || count <= 0 || elapsed <= 0 {
+		return
+	}
+
+	speed := float64(size) / elapsed
+	remain := float64(size) / float64(count) * float64(bar.Total()-bar.Current())
+	// 有ts时长时按码率估算，变码率视频更准确
+	done := atomic.LoadInt64(&doneDuration)
+	total := atomic.LoadInt64(&totalDuration)
+	if total > 0 {
+		bitrate := sampledBitrate
+		if done > 0 {
+			bitrate = float64(size) / (float64(done) / 1000)
+		}
+		if bitrate > 0 {
+			remain = bitrate * float64(total-done) / 1000
+		}
+	}
+	eta := time.Duration(remain / speed * float64(time.Second)).Round(time.Second)
+	bar.Set("speed", fmt.Sprintf("%.2f MB/s", speed/1024/1024))
+	bar.Set("eta", "ETA "+eta.String())
 }
 
 func getFileName(uri string) string {
+	if preservePaths {
+		// 保留目录结构时使用url的路径，Clean防止..跳出输出目录
+		if u, err := url.Parse(uri); err == nil && u.Path != "" {
+			return strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+		}
+	}
+	if stripQuery {
+		// 文件名去掉url参数，token变化时断点续传也能对应上
+		if u, err := url.Parse(uri); err == nil && u.Path != "" {
+			uri = u.Path
+		}
+	}
 	index := strings.LastIndex(uri, "/")
 	// 根据路径 + 文件.ts 拼接路径 （直接创建文件）
 	name := uri[index+1:]
@@ -255,6 +1556,12 @@ func getFileName(uri string) string {
 func getFilePath(uri string, playlistUrl *url.URL) string {
 	// 获取uri的绝对路径
 	uri = getAbsoluteUri(uri, playlistUrl)
+	if preservePaths {
+		// 保留目录结构时文件名为完整路径，基础路径只到域名
+		if u, err := url.Parse(uri); err == nil {
+			return u.Scheme + "://" + u.Host + "/"
+		}
+	}
 	index := strings.LastIndex(uri, "/")
 	// 根据路径 + 文件.ts 拼接路径 （直接创建文件）
 	path := uri[:index+1]
@@ -262,134 +1569,994 @@ func getFilePath(uri string, playlistUrl *url.URL) string {
 }
 
 func getContinuePlaylist(dlc chan *Download) {
+	// 关闭通道
+	defer close(dlc)
+	continuePlaylist(dlc)
+}
+
+// 直播断点续传，先下载上次未完成的ts，再从上次最后的媒体序列号之后继续轮询
+func getContinueLive(dlc chan *Download) {
+	defer close(dlc)
+	continuePlaylist(dlc)
+	continueLive(dlc)
+}
+
+func continueLive(dlc chan *Download) {
+	defer catchException()
+
+	urlStr := downloadProcess.MediaUrl
+	playlistUrl, err := url.Parse(urlStr)
+	if err != nil {
+		log.Panic(err)
+	}
+	playlist, _, data := fetchPlaylist(urlStr)
+	mpl, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		log.Panic("Not a valid media playlist: " + urlStr)
+	}
+	// 中断期间直播窗口已经移过了上次的位置，中间的ts无法再下载
+	next := downloadProcess.LastSeq + 1
+	if mpl.SeqNo > next {
+		log.Printf("warning: live window moved past sequence %d, segments %d-%d are lost\n", downloadProcess.LastSeq, next, mpl.SeqNo-1)
+	}
+	gaps := parseGaps(data)
+	addAdSegments(gaps, data)
+	skipUnsupported(mpl, gaps)
+	skipBefore(mpl, gaps, false)
+	skipSeq(mpl, gaps, next)
+	skipAfter(mpl, gaps, next)
+	cache := newDedupCache(mpl)
+	added := addMediaList(mpl, playlistUrl, "", gaps, cache, dlc)
+	bar.AddTotal(int64(added))
+	pollPlaylist(urlStr, mpl, playlistUrl, cache, dlc, next)
+}
+
+func continuePlaylist(dlc chan *Download) {
 	// defer 在资源释放、连接关闭、函数结束时调用
 	// 多个defer为堆栈结构，先进后出，也就是先进的后执行
 	defer catchException()
 
-	// 进度条
-	bar = pb.StartNew(len(downloadProcess.MediaList))
+	// 进度条，按列表顺序继续下载，保证和总数一致
+	list := append(append([]string{}, downloadProcess.MediaList...), downloadProcess.AudioList...)
+	startBar(len(list))
 	downloadProcess.status = &sync.Map{}
-	for key, value := range downloadProcess.MediaStatus {
-		if value == false {
+	for i, key := range list {
+		if downloadProcess.MediaStatus[key] == false {
 			downloadProcess.status.Store(key, false)
-			dlc <- &Download{downloadProcess.Path + key}
+			addByteTotal(downloadProcess.Ranges[key].Limit)
+			v := getContinueDownload(key)
+			v.Order = i
+			if i >= len(downloadProcess.MediaList) {
+				v.Order = i - len(downloadProcess.MediaList)
+			}
+			dlc <- v
 		} else {
 			downloadProcess.status.Store(key, true)
 			// 已完成的文件数
 			bar.Increment()
 		}
 	}
-	// 关闭通道
-	close(dlc)
 }
 
-func getPlaylist(urlStr string, dlc chan *Download) {
-	// defer 在资源释放、连接关闭、函数结束时调用
-	// 多个defer为堆栈结构，先进后出，也就是先进的后执行
-	defer catchException()
+// 根据文件名还原下载链接和字节范围，音频文件在audio子目录下
+func getContinueDownload(name string) *Download {
+	file := name
+	r, ok := downloadProcess.Ranges[name]
+	if ok {
+		file = r.File
+	}
+	uri := downloadProcess.Path + file
+	if strings.HasPrefix(file, audioDir+"/") {
+		uri = downloadProcess.AudioPath + strings.TrimPrefix(file, audioDir+"/")
+	}
+	if refreshed, ok := refreshedUris[refreshKey(file)]; ok {
+		uri = refreshed
+	}
+	if dataUri, ok := downloadProcess.DataUris[name]; ok {
+		uri = dataUri
+	}
+	return &Download{URI: uri, Name: name, Offset: r.Offset, Limit: r.Limit}
+}
 
-	cache := lru.New(1024)
-	playlistUrl, err := url.Parse(urlStr)
+// 字节范围的ts文件名，在扩展名前加上偏移量，例如 video_1024.ts
+func getRangeFileName(file string, offset int64) string {
+	ext := path.Ext(file)
+	return strings.TrimSuffix(file, ext) + "_" + strconv.FormatInt(offset, 10) + ext
+}
+
+// m3u8文件的ETag和Last-Modified，轮询时带上，未变化时服务器返回304
+type playlistTag struct {
+	etag         string
+	lastModified string
+}
+
+var playlistTags sync.Map
+
+// 请求并解析m3u8文件，同时返回原始内容，m3u8未变化时返回nil
+func fetchPlaylist(urlStr string) (m3u8.Playlist, m3u8.ListType, []byte) {
+	// 有效期内的缓存直接使用，不请求服务器
+	if data := loadManifestCache(urlStr); data != nil {
+		if playlist, listType, err := decodePlaylist(urlStr, data); err == nil {
+			savePlaylistDump(urlStr, data, listType)
+			return playlist, listType, data
+		}
+	}
+	playlist, listType, data, err := requestPlaylist(urlStr)
 	if err != nil {
 		log.Panic(err)
 	}
+	if playlist != nil {
+		saveManifestCache(urlStr, playlist, data)
+	}
+	return playlist, listType, data
+}
 
-	req, err := http.NewRequest("GET", urlStr, nil)
+// 不使用缓存，直接向服务器请求m3u8，失败时返回错误
+func requestPlaylist(urlStr string) (m3u8.Playlist, m3u8.ListType, []byte, error) {
+	// m3u8文件请求失败时重试
+	var resp *http.Response
+	err := retry(playlistRetry, func() error {
+		req, err := http.NewRequest("GET", urlStr, nil)
+		if err != nil {
+			return err
+		}
+		// 部分服务器按Accept返回内容，不指定时返回网页
+		req.Header.Set("Accept", playlistAccept)
+		// 要求CDN回源获取最新的m3u8
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+			req.Header.Set("Pragma", "no-cache")
+		}
+		if value, ok := playlistTags.Load(urlStr); ok {
+			tag := value.(playlistTag)
+			if tag.etag != "" {
+				req.Header.Set("If-None-Match", tag.etag)
+			}
+			if tag.lastModified != "" {
+				req.Header.Set("If-Modified-Since", tag.lastModified)
+			}
+		}
+		resp, err = doPlaylistRequest(client, req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotModified {
+			resp.Body.Close()
+			return fmt.Errorf("received HTTP %v for %v", resp.StatusCode, urlStr)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil, 0, nil, err
 	}
-	resp, err := doRequest(client, req)
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, 0, nil, nil
+	}
+	playlistTags.Store(urlStr, playlistTag{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")})
+	data, err := readPlaylist(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		log.Print(err)
-		time.Sleep(time.Duration(3) * time.Second)
+		return nil, 0, nil, err
 	}
-	playlist, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	playlist, listType, err := decodePlaylist(urlStr, data)
+	// 解析失败的m3u8也保存，方便排查
+	savePlaylistDump(resp.Request.URL.String(), data, listType)
 	if err != nil {
-		log.Panic(err)
+		return nil, 0, nil, err
 	}
-	resp.Body.Close()
+	return playlist, listType, data, nil
+}
 
-	// media 类型
-	if listType == m3u8.MEDIA {
-		mpl := playlist.(*m3u8.MediaPlaylist)
+// --max-playlist-size解析后的字节数
+var maxPlaylistBytes int64 = 50 << 20
 
-		// 初始化map
-		downloadProcess.status = &sync.Map{}
-		for _, vv := range mpl.Segments {
-			if vv != nil {
-				name := getFileName(vv.URI)
-				if downloadProcess.Path == "" {
-					downloadProcess.Path = getFilePath(vv.URI, playlistUrl)
-				}
+// 读取m3u8文件内容，超过大小上限时报错
+func readPlaylist(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxPlaylistBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxPlaylistBytes {
+		return nil, fmt.Errorf("playlist is larger than %d bytes, use --max-playlist-size to raise the limit", maxPlaylistBytes)
+	}
+	return data, nil
+}
 
-				downloadProcess.status.Store(name, false)
-				downloadProcess.MediaList = append(downloadProcess.MediaList, name)
+// 先按严格模式解析m3u8，失败时按宽松模式解析，兼容播放器能播放的不规范m3u8
+func decodePlaylist(urlStr string, data []byte) (m3u8.Playlist, m3u8.ListType, error) {
+	if bytes.Contains(data, []byte("#EXT-X-INDEPENDENT-SEGMENTS")) {
+		atomic.StoreInt32(&independentSegments, 1)
+	}
+	playlist, listType, err := m3u8.DecodeFrom(bytes.NewReader(data), true)
+	if err == nil {
+		return playlist, listType, nil
+	}
+	lenient, lenientType, lenientErr := m3u8.DecodeFrom(bytes.NewReader(data), false)
+	if lenientErr != nil {
+		return nil, 0, err
+	}
+	log.Printf("warning: %v is not a strictly valid m3u8 (%v), parsed it leniently\n", urlStr, err)
+	return lenient, lenientType, nil
+}
+
+// 去重的缓存，点播的ts是确定的，不限制大小完全去重，直播按窗口大小保留最近的链接
+func newDedupCache(mpl *m3u8.MediaPlaylist) *lru.Cache {
+	if dedupCacheSize > 0 {
+		return lru.New(dedupCacheSize)
+	}
+	if mpl.Closed || mpl.MediaType == m3u8.VOD {
+		return lru.New(0)
+	}
+	size := int(mpl.Count()) * 4
+	if size < defaultDedupCacheSize {
+		size = defaultDedupCacheSize
+	}
+	return lru.New(size)
+}
+
+// 直播按TargetDuration轮询，直到出现结束标签或者达到限制的时长，媒体序列号小于minSeq的ts跳过
+// 点播类型不会再变化，指定了--live-idle-timeout时超过这么久没有新的ts也认为已经结束
+func pollPlaylist(urlStr string, mpl *m3u8.MediaPlaylist, playlistUrl *url.URL, cache *lru.Cache, dlc chan *Download, minSeq uint64) {
+	// 记录是否为直播，中断后断点续传时继续轮询
+	// 下载协程同时在写入进度文件，需要加锁
+	downloadProcess.Lock()
+	downloadProcess.Live = !mpl.Closed && mpl.MediaType != m3u8.VOD
+	downloadProcess.Unlock()
+	lastNew := time.Now()
+	idle := false
+	for !mpl.Closed && mpl.MediaType != m3u8.VOD && sampleSegments == 0 && !durationReached() && !segmentsReached("") && !clipEndReached {
+		if liveIdleTimeout > 0 && time.Since(lastNew) >= liveIdleTimeout {
+			idle = true
+			break
+		}
+		time.Sleep(pollInterval(mpl))
+		playlist, _, data := fetchPlaylist(urlStr)
+		if playlist == nil {
+			// 304 m3u8未变化
+			continue
+		}
+		next, ok := playlist.(*m3u8.MediaPlaylist)
+		if !ok {
+			log.Panic("Not a valid media playlist")
+		}
+		mpl = next
+		gaps := parseGaps(data)
+		addAdSegments(gaps, data)
+		skipUnsupported(mpl, gaps)
+		skipBefore(mpl, gaps, false)
+		skipSeq(mpl, gaps, minSeq)
+		skipAfter(mpl, gaps, nextSeq())
+		added := addMediaList(mpl, playlistUrl, "", gaps, cache, dlc)
+		bar.AddTotal(int64(added))
+		if added > 0 {
+			lastNew = time.Now()
+		}
+	}
+	if idle {
+		log.Printf("playlist has no new segments for %s, treat it as finished\n", liveIdleTimeout)
+	}
+	// 直播已经结束，断点续传时不再轮询
+	if mpl.Closed || idle {
+		downloadProcess.Lock()
+		downloadProcess.Live = false
+		downloadProcess.Unlock()
+	}
+}
+
+// 下一个还没有加入下载的媒体序列号，还没有ts时为0
+func nextSeq() uint64 {
+	downloadProcess.Lock()
+	defer downloadProcess.Unlock()
+	if len(downloadProcess.MediaList) == 0 {
+		return 0
+	}
+	return downloadProcess.LastSeq + 1
+}
+
+// 查找EXT-X-GAP标记的ts序号，m3u8库不解析这个标签
+func parseGaps(data []byte) map[int]bool {
+	gaps := make(map[int]bool)
+	index := 0
+	gap := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-GAP"):
+			gap = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			// ts链接行，标签作用于下一个ts
+			if gap {
+				gaps[index] = true
 			}
+			index++
+			gap = false
 		}
+	}
+	return gaps
+}
 
-		// 进度条
-		bar = pb.StartNew(len(downloadProcess.MediaList))
+// 记录media playlist中的ts文件列表和状态，边解析边放入下载队列，dir为音频子目录
+// gaps为EXT-X-GAP标记的ts序号，不下载也不合并，cache用于直播轮询时去重，返回新增的ts数量
+func addMediaList(mpl *m3u8.MediaPlaylist, playlistUrl *url.URL, dir string, gaps map[int]bool, cache *lru.Cache, dlc chan *Download) int {
+	// 先统计新增的总时长，用于估算剩余时间
+	var duration float64
+	index := 0
+	for _, v := range mpl.Segments {
+		if v != nil {
+			if _, hit := cache.Get(getAbsoluteUri(v.URI, playlistUrl)); !hit && !gaps[index] {
+				duration += v.Duration
+			}
+			index++
+		}
+	}
+	atomic.AddInt64(&totalDuration, int64(duration*1000))
 
-		for _, v := range mpl.Segments {
-			// ts文件列表
-			if v != nil {
-				// 获取绝对路径uri
-				var msURI = getAbsoluteUri(v.URI, playlistUrl)
-				_, hit := cache.Get(msURI)
-				if !hit {
-					cache.Add(msURI, nil)
-					dlc <- &Download{msURI}
-				}
+	added := 0
+	index = -1
+	// 上一个字节范围的文件和结束位置，没有写偏移量时紧接着上一个范围
+	var lastURI string
+	var lastEnd int64
+	// EXT-X-KEY作用于之后所有的ts，直到下一个EXT-X-KEY。
+	// 解析时第一个EXT-X-KEY也会写入mpl.Key，即使它在几个不加密的ts之后，所以只按每个ts上的Key计算
+	var xkey *m3u8.Key
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		index++
+		if v.Key != nil {
+			xkey = v.Key
+		}
+		if gaps[index] {
+			continue
+		}
+		// 达到限制的ts个数后不再加入
+		if segmentsReached(dir) {
+			break
+		}
+		// 获取绝对路径uri，已经加入过的跳过
+		var msURI = getAbsoluteUri(v.URI, playlistUrl)
+		key := msURI
+		offset := v.Offset
+		if v.Limit > 0 {
+			if offset == 0 && msURI == lastURI {
+				offset = lastEnd
 			}
+			lastURI = msURI
+			lastEnd = offset + v.Limit
+			// 同一个文件的不同范围分别下载
+			key = fmt.Sprintf("%s@%d-%d", msURI, offset, v.Limit)
 		}
-		if mpl.Closed {
-			// 需要需要确认什么情况下回关闭（这个地方有问题）
-			close(dlc)
-			return
+		if _, hit := cache.Get(key); hit {
+			continue
+		}
+		cache.Add(key, nil)
+
+		file := getFileName(msURI)
+		isData := strings.HasPrefix(msURI, "data:")
+		if isData {
+			// data:链接没有文件名，按序号命名
+			file = fmt.Sprintf("data_%d.ts", index)
+		}
+		if dir != "" {
+			file = dir + "/" + file
+		}
+		name := file
+		var order int
+		// 下载协程会同时写入进度文件，修改列表需要加锁
+		downloadProcess.Lock()
+		if isData {
+			if downloadProcess.DataUris == nil {
+				downloadProcess.DataUris = make(map[string]string)
+			}
+			downloadProcess.DataUris[name] = msURI
+		}
+		if v.Limit > 0 {
+			// 字节范围的ts写入各自的文件
+			name = getRangeFileName(file, offset)
+			if downloadProcess.Ranges == nil {
+				downloadProcess.Ranges = make(map[string]ByteRange)
+			}
+			downloadProcess.Ranges[name] = ByteRange{File: file, Offset: offset, Limit: v.Limit}
+		}
+		if dir == "" {
+			if downloadProcess.Path == "" {
+				downloadProcess.Path = getFilePath(v.URI, playlistUrl)
+			}
+			downloadProcess.MediaList = append(downloadProcess.MediaList, name)
+			order = len(downloadProcess.MediaList) - 1
+			if seq := mpl.SeqNo + uint64(index); seq > downloadProcess.LastSeq {
+				downloadProcess.LastSeq = seq
+			}
 		} else {
-			time.Sleep(time.Duration(int64(mpl.TargetDuration * 1000000000)))
+			if downloadProcess.AudioPath == "" {
+				downloadProcess.AudioPath = getFilePath(v.URI, playlistUrl)
+			}
+			downloadProcess.AudioList = append(downloadProcess.AudioList, name)
+			order = len(downloadProcess.AudioList) - 1
+		}
+		if downloadProcess.Durations == nil {
+			downloadProcess.Durations = make(map[string]float64)
+		}
+		downloadProcess.Durations[name] = v.Duration
+		setSegmentKey(name, xkey, mpl.SeqNo+uint64(index), playlistUrl)
+		downloadProcess.Unlock()
+		downloadProcess.status.Store(name, false)
+		addByteTotal(v.Limit)
+
+		added++
+		dlc <- &Download{URI: msURI, Name: name, Duration: v.Duration, Offset: offset, Limit: v.Limit, Order: order}
+	}
+	return added
+}
+
+// 获取m3u8并放入下载队列，结束或者出错时都关闭通道，防止下载协程一直阻塞
+func getPlaylist(urlStr string, dlc chan *Download) {
+	defer close(dlc)
+	loadPlaylist(urlStr, dlc)
+}
+
+func loadPlaylist(urlStr string, dlc chan *Download) {
+	// defer 在资源释放、连接关闭、函数结束时调用
+	// 多个defer为堆栈结构，先进后出，也就是先进的后执行
+	defer catchException()
+
+	playlistUrl, err := url.Parse(urlStr)
+	if err != nil {
+		log.Panic(err)
+	}
+	playlist, listType, data := fetchPlaylist(urlStr)
+
+	// media 类型
+	if listType == m3u8.MEDIA {
+		mpl := playlist.(*m3u8.MediaPlaylist)
+		// 记录实际下载的链接，断点续传时复用，下载协程同时在写入进度文件，需要加锁
+		downloadProcess.Lock()
+		downloadProcess.MediaUrl = urlStr
+		downloadProcess.Unlock()
+		// 已经结束的m3u8没有ts时报错结束
+		if mpl.Count() == 0 && (mpl.Closed || mpl.MediaType == m3u8.VOD) {
+			startBar(0)
+			log.Panic("playlist contains no segments: " + urlStr)
 		}
+		// 抽样估算总大小
+		if sizeSamples > 0 {
+			sampleSize(mpl, playlistUrl, sizeSamples)
+		}
+
+		// 进度条，总数直接取m3u8的ts数量，不用等列表生成完，GAP标记的ts不下载
+		gaps := parseGaps(data)
+		if len(gaps) > 0 {
+			fmt.Printf("skip %d gap segments\n", len(gaps))
+		}
+		if ads := addAdSegments(gaps, data); ads > 0 {
+			fmt.Printf("skip %d ad segments\n", ads)
+		}
+		skipUnsupported(mpl, gaps)
+		skipBefore(mpl, gaps, true)
+		skipAfter(mpl, gaps, 0)
+		skipSample(mpl, gaps)
+		startBar(int(mpl.Count()) - len(gaps))
+
+		// ts文件列表
+		initStatus()
+		cache := newDedupCache(mpl)
+		added := addMediaList(mpl, playlistUrl, "", gaps, cache, dlc)
+		// 重复的ts只下载一次，修正进度条总数
+		bar.SetTotal(int64(added))
+
+		pollPlaylist(urlStr, mpl, playlistUrl, cache, dlc, 0)
 	} else if listType == m3u8.MASTER {
 		// 数据类型转换 m3u8.Playlist 转成  *m3u8.MasterPlaylist
 		mpl := playlist.(*m3u8.MasterPlaylist)
 		// 获取最大带宽，对应的链接index.m3u8
-		var masterURI string
-		var maxBandwidth uint32 = 0
-		for _, v := range mpl.Variants {
-			if v.Bandwidth > maxBandwidth {
-				maxBandwidth = v.Bandwidth
-				masterURI = v.URI
+		variant := selectVariant(mpl)
+		// 断点续传时选择和上次相同的码率，带宽变化后也不会换成其它码率
+		if downloadProcess.Bandwidth != 0 {
+			variant = matchVariant(mpl)
+		}
+		// 同一码率有多个镜像时测速选择最快的
+		if probeMirrors && variant != nil {
+			if mirrors := sameQualityVariants(mpl, variant); len(mirrors) > 1 {
+				variant = fastestMirror(mirrors, playlistUrl)
+				downloadProcess.Mirror = getAbsoluteUri(variant.URI, playlistUrl)
+				fmt.Println("use the fastest mirror " + variant.URI)
 			}
 		}
+		var masterURI string
+		if variant != nil {
+			masterURI = variant.URI
+			downloadProcess.Bandwidth = variant.Bandwidth
+			downloadProcess.Resolution = variant.Resolution
+		}
 
 		// 获取绝对路径
 		var msURI = getAbsoluteUri(masterURI, playlistUrl)
 		fmt.Println("master m3u8 url " + msURI)
+		// 同时下载选中码率对应的音频
+		if concurrentPlaylists {
+			if audioURI := getAudioUri(mpl, variant); audioURI != "" {
+				audioURI = getAbsoluteUri(audioURI, playlistUrl)
+				fmt.Println("audio m3u8 url " + audioURI)
+				loadRenditions(msURI, audioURI, dlc)
+				return
+			}
+		}
 		// 调用获取media playlist
-		getPlaylist(msURI, dlc)
+		loadPlaylist(msURI, dlc)
 	} else {
 		log.Panic("Not a valid media playlist")
 	}
 }
 
+// 默认选择最大带宽的码率，--preview时选择最小带宽的码率
+func selectVariant(mpl *m3u8.MasterPlaylist) *m3u8.Variant {
+	var variant *m3u8.Variant
+	// 只下载I帧列表，选择带宽最大的
+	if iframesOnly {
+		for _, v := range mpl.Variants {
+			if v != nil && v.Iframe && (variant == nil || v.Bandwidth > variant.Bandwidth) {
+				variant = v
+			}
+		}
+		if variant != nil {
+			return variant
+		}
+		fmt.Println("no I-frame playlist in the master playlist, use the normal variant")
+	}
+	if preview {
+		for _, v := range mpl.Variants {
+			if v == nil || v.Iframe {
+				continue
+			}
+			if variant == nil || v.Bandwidth < variant.Bandwidth {
+				variant = v
+			}
+		}
+		return variant
+	}
+	var maxBandwidth uint32 = 0
+	for _, v := range mpl.Variants {
+		if v != nil && v.Bandwidth > maxBandwidth {
+			maxBandwidth = v.Bandwidth
+			variant = v
+		}
+	}
+	return variant
+}
+
+// 获取码率对应的音频链接，优先默认音频
+func getAudioUri(mpl *m3u8.MasterPlaylist, variant *m3u8.Variant) string {
+	if variant == nil || variant.Audio == "" {
+		return ""
+	}
+	var uri string
+	// 音频只挂在部分码率下面，需要遍历所有码率
+	for _, v := range mpl.Variants {
+		for _, alt := range v.Alternatives {
+			if alt == nil || alt.Type != "AUDIO" || alt.GroupId != variant.Audio || alt.URI == "" {
+				continue
+			}
+			if alt.Default {
+				return alt.URI
+			}
+			if uri == "" {
+				uri = alt.URI
+			}
+		}
+	}
+	return uri
+}
+
+// 视频和音频同时获取和下载，结束或者出错时都关闭通道
+func getRenditions(videoUrl string, audioUrl string, dlc chan *Download) {
+	defer close(dlc)
+	loadRenditions(videoUrl, audioUrl, dlc)
+}
+
+// 视频和音频同时获取和下载，共用下载协程，进度条为两者之和
+func loadRenditions(videoUrl string, audioUrl string, dlc chan *Download) {
+	defer catchException()
+
+	videoPlaylistUrl, err := url.Parse(videoUrl)
+	if err != nil {
+		log.Panic(err)
+	}
+	audioPlaylistUrl, err := url.Parse(audioUrl)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var video, audio m3u8.Playlist
+	var videoData, audioData []byte
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer catchException()
+		video, _, videoData = fetchPlaylist(videoUrl)
+	}()
+	go func() {
+		defer wg.Done()
+		defer catchException()
+		audio, _, audioData = fetchPlaylist(audioUrl)
+	}()
+	wg.Wait()
+
+	videoList, ok := video.(*m3u8.MediaPlaylist)
+	if !ok {
+		log.Panic("Not a valid media playlist: " + videoUrl)
+	}
+	audioList, ok := audio.(*m3u8.MediaPlaylist)
+	if !ok {
+		log.Panic("Not a valid media playlist: " + audioUrl)
+	}
+	// 只下载当前的ts，不轮询两个列表，直播时直接报错，不会只下载到开头的一段
+	for _, mpl := range []*m3u8.MediaPlaylist{videoList, audioList} {
+		if !mpl.Closed && mpl.MediaType != m3u8.VOD {
+			log.Panic("--concurrent-playlists does not support live playlists, run without it to download the live stream")
+		}
+	}
+
+	// 记录实际下载的链接，断点续传时复用
+	downloadProcess.Lock()
+	downloadProcess.MediaUrl = videoUrl
+	downloadProcess.AudioUrl = audioUrl
+	downloadProcess.Unlock()
+
+	// 进度条，GAP标记的ts不下载
+	videoGaps := parseGaps(videoData)
+	audioGaps := parseGaps(audioData)
+	addAdSegments(videoGaps, videoData)
+	addAdSegments(audioGaps, audioData)
+	skipUnsupported(videoList, videoGaps)
+	skipUnsupported(audioList, audioGaps)
+	skipBefore(videoList, videoGaps, true)
+	skipBefore(audioList, audioGaps, true)
+	skipAfter(videoList, videoGaps, 0)
+	skipAfter(audioList, audioGaps, 0)
+	skipSample(videoList, videoGaps)
+	skipSample(audioList, audioGaps)
+	startBar(int(videoList.Count()+audioList.Count()) - len(videoGaps) - len(audioGaps))
+
+	// 两个列表同时入队
+	initStatus()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		added := addMediaList(videoList, videoPlaylistUrl, "", videoGaps, newDedupCache(videoList), dlc)
+		bar.AddTotal(int64(added) - int64(videoList.Count()) + int64(len(videoGaps)))
+	}()
+	go func() {
+		defer wg.Done()
+		added := addMediaList(audioList, audioPlaylistUrl, audioDir, audioGaps, newDedupCache(audioList), dlc)
+		bar.AddTotal(int64(added) - int64(audioList.Count()) + int64(len(audioGaps)))
+	}()
+	wg.Wait()
+}
+
+// 均匀抽取几个ts文件请求Content-Length，按时长估算码率和总大小
+func sampleSize(mpl *m3u8.MediaPlaylist, playlistUrl *url.URL, samples int) {
+	var segments []*m3u8.MediaSegment
+	var totalSeconds float64
+	for _, v := range mpl.Segments {
+		if v != nil {
+			segments = append(segments, v)
+			totalSeconds += v.Duration
+		}
+	}
+	if len(segments) == 0 {
+		return
+	}
+	if samples > len(segments) {
+		samples = len(segments)
+	}
+
+	var size int64
+	var duration float64
+	for i := 0; i < samples; i++ {
+		v := segments[i*len(segments)/samples]
+		req, err := http.NewRequest(http.MethodHead, getAbsoluteUri(v.URI, playlistUrl), nil)
+		if err != nil {
+			continue
+		}
+		resp, err := doRequest(client, req)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.ContentLength <= 0 || v.Duration <= 0 {
+			continue
+		}
+		size += resp.ContentLength
+		duration += v.Duration
+	}
+	if duration <= 0 {
+		return
+	}
+
+	sampledBitrate = float64(size) / duration
+	fmt.Printf("estimated size: %.2f MB\n", sampledBitrate*totalSeconds/1024/1024)
+}
+
+// 跳过开始位置之前的ts，和GAP一样不下载也不合并
+// 按序号跳过只用于第一次获取的m3u8，直播轮询时只按媒体序列号跳过
+func skipBefore(mpl *m3u8.MediaPlaylist, skips map[int]bool, first bool) {
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if (first && index < startSegment) || mpl.SeqNo+uint64(index) < startSeq {
+			skips[index] = true
+		}
+		index++
+	}
+	skipTime(mpl, skips)
+	// 没有声明每个ts可以单独解码时，截取的第一个ts可能不是从关键帧开始
+	if (startSegment > 0 || startSeq > 0 || !clipStart.IsZero()) && atomic.LoadInt32(&independentSegments) == 0 {
+		independentWarning.Do(func() {
+			log.Println("warning: the playlist does not declare EXT-X-INDEPENDENT-SEGMENTS, the clip may not start on a keyframe and glitch at the beginning")
+		})
+	}
+}
+
+// 按EXT-X-PROGRAM-DATE-TIME跳过开始时间之前和结束时间之后的ts
+// 没有时间标签的ts按前后有时间的ts加减时长推算，m3u8中完全没有时间标签时不按时间跳过
+func skipTime(mpl *m3u8.MediaPlaylist, skips map[int]bool) {
+	if clipStart.IsZero() && clipEnd.IsZero() {
+		return
+	}
+	// 第一个时间标签之前的ts，从第一个时间标签往前推算
+	var t time.Time
+	var before float64
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if !v.ProgramDateTime.IsZero() {
+			t = v.ProgramDateTime.Add(-time.Duration(before * float64(time.Second)))
+			break
+		}
+		before += v.Duration
+	}
+	if t.IsZero() {
+		programDateTimeWarning.Do(func() {
+			log.Println("no EXT-X-PROGRAM-DATE-TIME in the playlist, --start-time and --end-time are ignored")
+		})
+		return
+	}
+
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if !v.ProgramDateTime.IsZero() {
+			t = v.ProgramDateTime
+		}
+		end := t.Add(time.Duration(v.Duration * float64(time.Second)))
+		if !clipStart.IsZero() && !end.After(clipStart) {
+			skips[index] = true
+		}
+		if !clipEnd.IsZero() && !t.Before(clipEnd) {
+			skips[index] = true
+			// 直播已经超过结束时间，不再轮询
+			clipEndReached = true
+		}
+		t = end
+		index++
+	}
+}
+
+// 已经提示过的无法下载的链接，直播轮询时不重复提示
+var unsupportedWarned sync.Map
+
+// 空链接和blob:无法下载，和GAP一样跳过，进度条总数也不计入
+func skipUnsupported(mpl *m3u8.MediaPlaylist, skips map[int]bool) {
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if v.URI == "" || strings.HasPrefix(v.URI, "blob:") {
+			skips[index] = true
+			if _, warned := unsupportedWarned.LoadOrStore(v.URI, true); !warned {
+				log.Printf("skip segment with unsupported uri %q\n", v.URI)
+			}
+		}
+		index++
+	}
+}
+
+// 跳过媒体序列号小于minSeq的ts，直播断点续传时跳过已经下载过的ts
+func skipSeq(mpl *m3u8.MediaPlaylist, skips map[int]bool, minSeq uint64) {
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if mpl.SeqNo+uint64(index) < minSeq {
+			skips[index] = true
+		}
+		index++
+	}
+}
+
+// 限制下载的时长，从已经加入下载的时长开始累计，达到后的ts跳过
+// 直播轮询时媒体序列号小于minSeq的ts已经加入过，不重复累计
+func skipAfter(mpl *m3u8.MediaPlaylist, skips map[int]bool, minSeq uint64) {
+	if maxDuration <= 0 {
+		return
+	}
+	total := float64(atomic.LoadInt64(&totalDuration)) / 1000
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if !skips[index] && mpl.SeqNo+uint64(index) >= minSeq {
+			if total >= maxDuration.Seconds() {
+				skips[index] = true
+			} else {
+				total += v.Duration
+			}
+		}
+		index++
+	}
+}
+
+// --sample时在剩余的ts中均匀选择几个，其它的跳过
+func skipSample(mpl *m3u8.MediaPlaylist, skips map[int]bool) {
+	if sampleSegments <= 0 {
+		return
+	}
+	var rest []int
+	index := 0
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		if !skips[index] {
+			rest = append(rest, index)
+		}
+		index++
+	}
+	if len(rest) <= sampleSegments {
+		return
+	}
+	keep := make(map[int]bool)
+	for i := 0; i < sampleSegments; i++ {
+		keep[rest[i*len(rest)/sampleSegments]] = true
+	}
+	for _, i := range rest {
+		if !keep[i] {
+			skips[i] = true
+		}
+	}
+}
+
+// 直播轮询间隔，TargetDuration缺失或异常时限制在合理范围内
+func pollInterval(mpl *m3u8.MediaPlaylist) time.Duration {
+	d := mpl.TargetDuration
+	if math.IsNaN(d) || math.IsInf(d, 0) || d <= 0 {
+		targetDurationWarning.Do(func() {
+			log.Printf("invalid target duration %v, poll playlist every %v\n", d, minPollInterval)
+		})
+		return minPollInterval
+	}
+	interval := time.Duration(d * float64(time.Second))
+	if interval < minPollInterval {
+		return minPollInterval
+	}
+	if interval > maxPollInterval {
+		return maxPollInterval
+	}
+	return interval
+}
+
+// 已加入下载的时长是否达到限制
+func durationReached() bool {
+	return maxDuration > 0 && atomic.LoadInt64(&totalDuration) >= maxDuration.Milliseconds()
+}
+
+// 是否已经达到限制的ts个数，dir为audio时统计音频
+func segmentsReached(dir string) bool {
+	if maxSegments <= 0 {
+		return false
+	}
+	downloadProcess.Lock()
+	defer downloadProcess.Unlock()
+	if dir == "" {
+		return len(downloadProcess.MediaList) >= maxSegments
+	}
+	return len(downloadProcess.AudioList) >= maxSegments
+}
+
+// 初始化ts文件内部状态
+func initStatus() {
+	if downloadProcess.status == nil {
+		downloadProcess.status = &sync.Map{}
+	}
+}
+
+// ts文件下载失败，记录状态和失败数
+func failSegment(v *Download, err error) {
+	setMediaStatus(v.Name, false)
+	atomic.AddInt64(&failedCount, 1)
+	reportSegmentError(v.URI, err)
+	// 有ts失败时保存进度后立即退出，之后仍然可以断点续传
+	if failFast {
+		failFastOnce.Do(func() {
+			writeJsonFile()
+			exitWithError(fmt.Errorf("segment %v failed: %v, abort because of --fail-fast", v.URI, err))
+		})
+	}
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusNotFound {
+		atomic.AddInt64(&notFoundCount, 1)
+	}
+	debugLog.Printf("segment %v failed: %v\n", v.URI, err)
+	DownloadOptions.segmentError(v.URI, err)
+}
+
 // 协程设置sync.map
-func setMediaStatus(uri string, value bool) {
-	downloadProcess.status.Store(getFileName(uri), value)
+func setMediaStatus(name string, value bool) {
+	downloadProcess.status.Store(name, value)
+}
+
+// ts文件是否已经下载成功
+func isDone(name string) bool {
+	done, ok := downloadProcess.status.Load(name)
+	return ok && done.(bool)
+}
+
+// 记录ts文件的sha256
+// 记录ts的字节数，不知道大小时不记录
+func setSize(name string, size int64) {
+	if size <= 0 {
+		return
+	}
+	downloadProcess.Lock()
+	if downloadProcess.Sizes == nil {
+		downloadProcess.Sizes = make(map[string]int64)
+	}
+	downloadProcess.Sizes[name] = size
+	downloadProcess.Unlock()
+}
+
+func setChecksum(name string, sum string) {
+	downloadProcess.Lock()
+	if downloadProcess.Checksums == nil {
+		downloadProcess.Checksums = make(map[string]string)
+	}
+	downloadProcess.Checksums[name] = sum
+	downloadProcess.Unlock()
 }
 
 func getAbsoluteUri(masterURI string, playlistUrl *url.URL) string {
 	var msURI string
 	var err error
 
+	// data:链接直接使用，不能转义
+	if strings.HasPrefix(masterURI, "data:") {
+		return masterURI
+	}
+
 	// 相对路径，转换成绝对路径
 	if !strings.HasPrefix(masterURI, "http") {
 		var masterURL *url.URL
 		masterURL, err = playlistUrl.Parse(masterURI)
-		masterURI = masterURL.String()
 		if err != nil {
 			log.Print(err)
 			return msURI
 		}
+		masterURI = masterURL.String()
 	}
 
 	msURI, err = url.QueryUnescape(masterURI)
@@ -410,24 +2577,109 @@ func listenSignal() {
 		syscall.SIGUSR1,
 		syscall.SIGUSR2,
 		syscall.SIGTSTP)
-	select {
-	case <-signs:
-		fmt.Println("exit program , signs: ", signs)
+	for sign := range signs {
+		// SIGUSR1只保存进度和输出状态，继续下载
+		if sign == syscall.SIGUSR1 {
+			writeJsonFile()
+			printStatus()
+			continue
+		}
+		fmt.Println("exit program , signs: ", sign)
 		writeJsonFile()
 		os.Exit(0)
 	}
 }
 
-func writeAndMergeFile(outPath string) {
+// 输出当前的下载状态
+func printStatus() {
+	var done int
+	if downloadProcess.status != nil {
+		downloadProcess.status.Range(func(k, v interface{}) bool {
+			if v.(bool) {
+				done++
+			}
+			return true
+		})
+	}
+	fmt.Printf("\nstatus: %d done, %d failed, %d active, %d bytes, elapsed %v\n",
+		done, atomic.LoadInt64(&failedCount), atomic.LoadInt64(&activeCount), atomic.LoadInt64(&downloadBytes), time.Since(startTime).Round(time.Second))
+}
+
+// outPath为ts文件目录，mergePath为合并文件的路径，不带扩展名
+func writeAndMergeFile(outPath string, mergePath string) error {
+	// 记录这次的合并文件，断点续传时换了名字也按最后一次记录
+	abs, err := filepath.Abs(mergePath)
+	if err != nil {
+		abs = mergePath
+	}
+	downloadProcess.Lock()
+	downloadProcess.MergePath = abs
+	downloadProcess.MergeExt = mergeExtension()
+	downloadProcess.Unlock()
 	// 写文件进度到文件中
 	writeJsonFile()
+	// 没有ts时不生成空的合并文件
+	if len(downloadProcess.MediaList) == 0 {
+		return errors.New("playlist contains no segments to download, nothing to merge")
+	}
+	if err := checkFailed(); err != nil {
+		return err
+	}
 	// 合并所有ts文件
-	mergeMediaFile(outPath)
+	return mergeMediaFile(outPath, mergePath)
+}
+
+// 默认有失败的ts时不合并，--keep-going允许有限个404的ts，合并时跳过
+func checkFailed() error {
+	failed := atomic.LoadInt64(&failedCount)
+	if failed == 0 || allowGaps {
+		return nil
+	}
+	notFound := atomic.LoadInt64(&notFoundCount)
+	if keepGoing > 0 && failed == notFound && notFound <= int64(keepGoing) {
+		fmt.Printf("warning: %d segments not found, the merged file has gaps\n", notFound)
+		return nil
+	}
+	return fmt.Errorf("%d segments failed (%d not found), rerun to retry them or use --keep-going", failed, notFound)
+}
+
+// 临时目录按输出路径生成固定的名字，断点续传时可以找到上次的ts文件
+func flatPath(outPath string) string {
+	abs, err := filepath.Abs(outPath)
+	if err != nil {
+		abs = outPath
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(os.TempDir(), "m3u8load-"+hex.EncodeToString(sum[:8]))
+}
+
+// 上次保存进度时完成的百分比档位
+var checkpointStep int64
+
+// --checkpoint-percent时每完成N%的ts保存一次进度，崩溃时最多丢失N%
+func checkpoint() {
+	if checkpointPercent <= 0 {
+		return
+	}
+	total := bar.Total()
+	if total <= 0 {
+		return
+	}
+	step := bar.Current() * 100 / total / int64(checkpointPercent)
+	last := atomic.LoadInt64(&checkpointStep)
+	if step > last && atomic.CompareAndSwapInt64(&checkpointStep, last, step) {
+		writeJsonFile()
+	}
 }
 
 func writeJsonFile() {
 	// 写入ts文件进度加锁
 	downloadProcess.Lock()
+	// 还没有开始下载，没有进度
+	if downloadProcess.dir == "" {
+		downloadProcess.Unlock()
+		return
+	}
 	// status写入到MediaStatus中
 	// 遍历所有sync.Map中的键值对，加锁判断是否初始化
 	if downloadProcess.MediaStatus == nil {
@@ -441,41 +2693,204 @@ func writeJsonFile() {
 
 	// 最后面4个空格，json格式缩进
 	result, _ := json.MarshalIndent(downloadProcess, "", "  ")
-	name := outPath + string(os.PathSeparator) + ".index"
-	_ = ioutil.WriteFile(name, result, 0644)
+	name := downloadProcess.dir + string(os.PathSeparator) + ".index"
+	_ = ioutil.WriteFile(name, result, fileMode)
+
+	// 额外导出方便查看的格式，断点续传仍然使用json
+	if stateExport != "" {
+		writeStateExport(name)
+	}
 
 	// 写入ts文件进度释放锁
 	downloadProcess.Unlock()
 }
 
-func mergeMediaFile(outPath string) {
-	fileName := outPath + ".ts"
+// 按列表顺序导出每个ts的状态，csv或者每行一个的文本格式
+func writeStateExport(name string) {
+	list := append(append([]string{}, downloadProcess.MediaList...), downloadProcess.AudioList...)
+	var buf bytes.Buffer
+	switch stateExport {
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"segment", "status"})
+		for _, value := range list {
+			w.Write([]string{value, stateName(downloadProcess.MediaStatus[value])})
+		}
+		w.Flush()
+	case "txt":
+		for _, value := range list {
+			buf.WriteString(value + " " + stateName(downloadProcess.MediaStatus[value]) + "\n")
+		}
+	default:
+		return
+	}
+	_ = ioutil.WriteFile(name+"."+stateExport, buf.Bytes(), fileMode)
+}
+
+func stateName(done bool) string {
+	if done {
+		return "complete"
+	}
+	return "pending"
+}
+
+func mergeMediaFile(outPath string, mergePath string) error {
+	if ext := getExtension(downloadProcess.MediaList, downloadProcess.ContentType); ext == ".mp4" || ext == ".m4a" {
+		fmt.Println("warning: fmp4 segments need the EXT-X-MAP init segment to play after concatenation")
+	}
+	ext := mergeExtension()
+	// 启动时已经校验过
+	size, _ := parseSize(splitSize)
+	if streamedOutput == mergePath+ext {
+		// 下载时已经按顺序合并完成
+		fmt.Println("merged while downloading: " + streamedOutput)
+	} else if err := mergeParts(outPath, mergePath, ext, downloadProcess.MediaList, size, splitCount); err != nil {
+		return err
+	}
+	// 音频单独合并
+	if len(downloadProcess.AudioList) > 0 {
+		return mergeParts(outPath, mergePath+".audio", audioExtension(), downloadProcess.AudioList, size, splitCount)
+	}
+	return nil
+}
+
+// 合并后视频文件的扩展名，--ext指定时只改文件名，不转换格式
+func mergeExtension() string {
+	if forceExt != "" {
+		return "." + strings.TrimPrefix(forceExt, ".")
+	}
+	return getExtension(downloadProcess.MediaList, downloadProcess.ContentType)
+}
+
+// 合并后音频文件的扩展名，按音频ts自己的Content-Type判断
+func audioExtension() string {
+	return getExtension(downloadProcess.AudioList, downloadProcess.AudioContentType)
+}
+
+// 根据ts文件扩展名判断合并文件的扩展名，无法判断时使用ts的Content-Type，默认.ts
+func getExtension(list []string, contentType string) string {
+	ext := ""
+	if len(list) > 0 {
+		switch e := strings.ToLower(path.Ext(list[0])); e {
+		case ".ts", ".aac", ".mp3", ".ac3":
+			ext = e
+		case ".m4s", ".mp4", ".m4v", ".cmfv":
+			ext = ".mp4"
+		case ".m4a", ".cmfa":
+			ext = ".m4a"
+		}
+	}
+	if ext == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "video/mp4", "video/iso.segment":
+			ext = ".mp4"
+		case "audio/mp4":
+			ext = ".m4a"
+		case "audio/aac":
+			ext = ".aac"
+		default:
+			ext = ".ts"
+		}
+	}
+	return ext
+}
+
+func mergeFile(outPath string, fileName string, list []string) (err error) {
+
+	// 命名管道在下载时已经写入
+	if isNamedPipe(fileName) {
+		fmt.Println("output file " + fileName + " is a named pipe, segments already streamed. ")
+		return nil
+	}
 
 	// 文件存在需要删除
 	if _, err := os.Stat(fileName); err == nil {
-		if err := os.Remove(fileName); err != nil {
+		// 返回错误，调用方不会当作合并成功，--flat时也不会删除ts
+		if noClobber {
+			return fmt.Errorf("output file %s already exists, not overwriting, remove it or run without --no-clobber", fileName)
+		}
+		if err := retryFileInUse(fileName, func() error { return os.Remove(fileName) }); err != nil {
+			if isFileInUse(err) {
+				return err
+			}
 			fmt.Println("remove file " + fileName + " failed. ")
 		}
 	}
 
-	tsMergeFile, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	var tsMergeFile io.WriteCloser
+	err = retryFileInUse(fileName, func() (err error) {
+		tsMergeFile, err = DownloadOptions.createOutput(fileName)
+		return err
+	})
+	if isFileInUse(err) {
+		return err
+	}
 	if err != nil {
-		panic(err)
-		return
+		return fmt.Errorf("create merged file %s: %w", fileName, err)
 	}
-	for _, value := range downloadProcess.MediaList {
-		tsFile, err := os.OpenFile(outPath+string(os.PathSeparator)+value, os.O_RDONLY, os.ModePerm)
-		if err != nil {
-			fmt.Println(err)
-			return
+	// 带缓冲写入，每隔几个ts刷新到磁盘，崩溃时不会丢失整个合并文件
+	writer := bufio.NewWriterSize(tsMergeFile, 1<<20)
+	// 最后刷新缓冲、同步到磁盘再关闭，任何一步失败都返回错误
+	defer func() {
+		if flushErr := writer.Flush(); flushErr != nil && err == nil {
+			err = fmt.Errorf("write merged file %s: %w", fileName, flushErr)
 		}
-		b, err := ioutil.ReadAll(tsFile)
-		if err != nil {
-			fmt.Println(err)
-			return
+		if syncErr := syncFile(tsMergeFile); syncErr != nil && err == nil {
+			err = fmt.Errorf("sync merged file %s: %w", fileName, syncErr)
+		}
+		if closeErr := tsMergeFile.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close merged file %s: %w", fileName, closeErr)
 		}
-		tsMergeFile.Write(b)
-		tsFile.Close()
+	}()
+	// 重写ts包的连续计数
+	var w io.Writer = writer
+	var cw *continuityWriter
+	if fixContinuity && strings.HasSuffix(fileName, ".ts") {
+		cw = newContinuityWriter(writer)
+		w = cw
 	}
+	for i, value := range list {
+		if err := copySegment(w, filepath.Join(outPath, filepath.FromSlash(value))); err != nil {
+			// 允许缺失时跳过读取失败的ts，否则中止合并
+			if !allowGaps && !(keepGoing > 0 && !isDone(value)) {
+				return fmt.Errorf("merge segment %s: %w, rerun to download it or use --allow-gaps", value, err)
+			}
+			fmt.Printf("skip segment %s: %v\n", value, err)
+			continue
+		}
+		if mergeSync > 0 && (i+1)%mergeSync == 0 {
+			if err := writer.Flush(); err != nil {
+				return fmt.Errorf("write merged file %s: %w", fileName, err)
+			}
+			if err := syncFile(tsMergeFile); err != nil {
+				return fmt.Errorf("sync merged file %s: %w", fileName, err)
+			}
+		}
+	}
+	if cw != nil {
+		if err := cw.Flush(); err != nil {
+			return fmt.Errorf("write merged file %s: %w", fileName, err)
+		}
+	}
+	return nil
+}
 
+// 支持Sync的输出同步到磁盘，自定义的输出不支持时跳过
+func syncFile(w io.Writer) error {
+	if f, ok := w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// 把一个ts文件的内容写入合并文件
+func copySegment(w io.Writer, name string) error {
+	tsFile, err := DownloadOptions.openSegment(name)
+	if err != nil {
+		return err
+	}
+	defer tsFile.Close()
+	_, err = io.Copy(w, tsFile)
+	return err
 }
@@ -0,0 +1,1632 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// --max-rps时相邻两个ts请求的间隔不小于1/rps秒
+func TestMaxRpsSpacing(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &maxRps, 20)
+	files := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		files["/"+strconv.Itoa(i)+".ts"] = tsData(1, 0)
+	}
+	var mu sync.Mutex
+	var stamps []time.Time
+	srv := newSegmentServer(t, files)
+	setGlobal(t, &DownloadOptions, &Options{OnSegmentStart: func(string) {
+		mu.Lock()
+		stamps = append(stamps, time.Now())
+		mu.Unlock()
+	}})
+
+	var list []*Download
+	for name := range files {
+		list = append(list, &Download{URI: srv.URL + name, Name: name[1:]})
+	}
+	downloadAll(dir, list)
+
+	if len(stamps) != len(files) {
+		t.Fatalf("started %d requests, want %d", len(stamps), len(files))
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].Before(stamps[j]) })
+	// 协程调度有少量误差
+	const interval = 50 * time.Millisecond
+	const slack = 5 * time.Millisecond
+	for i := 1; i < len(stamps); i++ {
+		if gap := stamps[i].Sub(stamps[i-1]); gap < interval-slack {
+			t.Errorf("request %d started %v after the previous one, want at least %v", i, gap, interval)
+		}
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := newRateLimiter(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		l.wait()
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("unlimited limiter waited %v", d)
+	}
+}
+
+// 两个码率的master，high带宽更大，每个码率两个ts
+func variantFiles() map[string][]byte {
+	return map[string][]byte{
+		"/master.m3u8": []byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000,RESOLUTION=1280x720\nhigh/index.m3u8\n"),
+		"/low/index.m3u8":  []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n#EXT-X-ENDLIST\n"),
+		"/high/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n#EXT-X-ENDLIST\n"),
+		"/low/a.ts":        tsData(1, 'l'),
+		"/low/b.ts":        tsData(1, 'l'),
+		"/high/a.ts":       tsData(1, 'h'),
+		"/high/b.ts":       tsData(1, 'h'),
+	}
+}
+
+// 断点续传时master中的带宽变化了，仍然继续下载上次选中的码率
+func TestResumeKeepsRendition(t *testing.T) {
+	dir := resetDownload(t)
+	files := variantFiles()
+	srv := newSegmentServer(t, files)
+	downloadPlaylist(srv.URL+"/master.m3u8", dir)
+	writeJsonFile()
+	if downloadProcess.Bandwidth != 2000 || downloadProcess.Resolution != "1280x720" {
+		t.Fatalf("selected bandwidth %d resolution %s, want the high variant", downloadProcess.Bandwidth, downloadProcess.Resolution)
+	}
+
+	// 第二个ts没有下载完成，之后低码率的带宽变得更大
+	os.Remove(filepath.Join(dir, "b.ts"))
+	files["/master.m3u8"] = []byte("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000,RESOLUTION=1280x720\nhigh/index.m3u8\n")
+	downloadProcess = &DownloadProcess{status: &sync.Map{}}
+	downloadPlaylist(srv.URL+"/master.m3u8", dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "b.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 'h' {
+		t.Errorf("resumed segment downloaded from another rendition")
+	}
+}
+
+// 上次只选了码率还没有获取media playlist，续传时按保存的带宽和分辨率重新选择
+func TestResumeMatchesSavedVariant(t *testing.T) {
+	dir := resetDownload(t)
+	files := variantFiles()
+	srv := newSegmentServer(t, files)
+	files["/master.m3u8"] = []byte("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000,RESOLUTION=1280x720\nhigh/index.m3u8\n")
+	index := []byte(`{"Bandwidth": 2000, "Resolution": "1280x720"}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".index"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	downloadPlaylist(srv.URL+"/master.m3u8", dir)
+
+	if want := srv.URL + "/high/index.m3u8"; downloadProcess.MediaUrl != want {
+		t.Errorf("resumed media url %s, want %s", downloadProcess.MediaUrl, want)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 'h' {
+		t.Errorf("resumed download switched rendition")
+	}
+}
+
+// --no-clobber时合并文件已存在返回错误，不覆盖原文件
+func TestMergeNoClobber(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &noClobber, true)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.ts"), tsData(1, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "out.ts")
+	if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeFile(dir, name, []string{"a.ts"}); err == nil {
+		t.Fatal("merge over an existing file succeeded with --no-clobber")
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "old" {
+		t.Errorf("existing output was overwritten")
+	}
+}
+
+// 100000个ts的点播m3u8
+func largePlaylist(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "#EXTINF:4,\nseg%d.ts\n", i)
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+// 从开始获取m3u8到第一个ts入队的时间，以及全部ts入队的时间
+func BenchmarkLargePlaylistStartup(b *testing.B) {
+	resetDownload(b)
+	srv := newSegmentServer(b, map[string][]byte{"/index.m3u8": largePlaylist(100000)})
+	var first, all time.Duration
+	for i := 0; i < b.N; i++ {
+		downloadProcess = &DownloadProcess{status: &sync.Map{}}
+		dlc := make(chan *Download, defaultQueueSize)
+		start := time.Now()
+		go getPlaylist(srv.URL+"/index.m3u8", dlc)
+		<-dlc
+		first += time.Since(start)
+		for range dlc {
+		}
+		all += time.Since(start)
+	}
+	b.ReportMetric(float64(first.Milliseconds())/float64(b.N), "ms/first-segment")
+	b.ReportMetric(float64(all.Milliseconds())/float64(b.N), "ms/all-segments")
+}
+
+// 解析100000个ts的m3u8的时间，第一个ts入队之前必须完成
+func BenchmarkLargePlaylistDecode(b *testing.B) {
+	data := largePlaylist(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodePlaylist("index.m3u8", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 直播轮询时带上ETag和Last-Modified，304时不解析，之后的新ts继续下载
+func TestPollConditionalRequests(t *testing.T) {
+	dir := resetDownload(t)
+	const head = "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	// 空字符串表示这次请求应该带上次的ETag并返回304
+	bodies := []string{
+		head + "#EXTINF:1,\nseg0.ts\n",
+		"",
+		head + "#EXTINF:1,\nseg0.ts\n#EXTINF:1,\nseg1.ts\n",
+		head + "#EXTINF:1,\nseg0.ts\n#EXTINF:1,\nseg1.ts\n#EXTINF:1,\nseg2.ts\n#EXT-X-ENDLIST\n",
+	}
+	var mu sync.Mutex
+	var requests []http.Header
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		i := len(requests)
+		requests = append(requests, r.Header.Clone())
+		mu.Unlock()
+		if i >= len(bodies) {
+			i = len(bodies) - 1
+		}
+		if bodies[i] == "" {
+			if r.Header.Get("If-None-Match") == fmt.Sprintf(`"v%d"`, i-1) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			i--
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, i))
+		w.Header().Set("Last-Modified", time.Unix(int64(1600000000+i), 0).UTC().Format(http.TimeFormat))
+		io.WriteString(w, bodies[i])
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tsData(1, 0))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/live.m3u8", dir)
+
+	if len(requests) != len(bodies) {
+		t.Fatalf("playlist requested %d times, want %d", len(requests), len(bodies))
+	}
+	if got := requests[1].Get("If-None-Match"); got != `"v0"` {
+		t.Errorf("second poll If-None-Match %q, want \"v0\"", got)
+	}
+	if got := requests[3].Get("If-None-Match"); got != `"v2"` {
+		t.Errorf("fourth poll If-None-Match %q, want \"v2\"", got)
+	}
+	if requests[3].Get("If-Modified-Since") == "" {
+		t.Errorf("fourth poll has no If-Modified-Since")
+	}
+	for _, name := range []string{"seg0.ts", "seg1.ts", "seg2.ts"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("segment %s not downloaded: %v", name, err)
+		}
+	}
+}
+
+// -n 5下载中断后用-n 20继续，进度条总数和完成数都按整个列表计算
+func TestResumeWithMoreWorkers(t *testing.T) {
+	dir := resetDownload(t)
+	const count = 30
+	var playlist bytes.Buffer
+	playlist.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:4\n")
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&playlist, "#EXTINF:4,\nseg%d.ts\n", i)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	var mu sync.Mutex
+	var broken bool
+	var active, maxActive int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(playlist.Bytes())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/seg%d.ts", &n)
+		mu.Lock()
+		fail := broken && n >= 12
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		// 第一次运行时后面的ts失败，相当于下载中断
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write(tsData(1, 0))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	broken = true
+	setGlobal(t, &parallel, 5)
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	writeJsonFile()
+	if maxActive > 5 {
+		t.Errorf("%d concurrent requests with -n 5", maxActive)
+	}
+
+	mu.Lock()
+	broken = false
+	maxActive = 0
+	mu.Unlock()
+	parallel = 20
+	atomic.StoreInt64(&failedCount, 0)
+	downloadProcess = &DownloadProcess{status: &sync.Map{}}
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if maxActive > 20 {
+		t.Errorf("%d concurrent requests with -n 20", maxActive)
+	}
+	if n := atomic.LoadInt64(&failedCount); n != 0 {
+		t.Errorf("%d segments failed after resume", n)
+	}
+	if bar.Total() != count || bar.Current() != count {
+		t.Errorf("progress %d/%d after resume, want %d/%d", bar.Current(), bar.Total(), count, count)
+	}
+	for i := 0; i < count; i++ {
+		if !isDone(fmt.Sprintf("seg%d.ts", i)) {
+			t.Errorf("seg%d.ts not done", i)
+		}
+	}
+	if err := mergeMediaFile(dir, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "out.ts")); err != nil || info.Size() != count*tsPacketSize {
+		t.Errorf("merged file size wrong: %v", err)
+	}
+}
+
+// 音频和视频的Content-Type分开记录，音频合并文件按音频的类型命名
+func TestAudioContentType(t *testing.T) {
+	dir := resetDownload(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video/seg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(tsData(1, 0))
+	})
+	mux.HandleFunc("/audio/seg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/aac")
+		w.Write([]byte{0xff, 0xf1})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// 没有扩展名时只能按Content-Type判断
+	downloadProcess.MediaList = []string{"seg"}
+	downloadProcess.AudioList = []string{audioDir + "/seg"}
+	downloadAll(dir, []*Download{
+		{URI: srv.URL + "/audio/seg", Name: audioDir + "/seg"},
+		{URI: srv.URL + "/video/seg", Name: "seg"},
+	})
+
+	if ext := mergeExtension(); ext != ".ts" {
+		t.Errorf("video extension %s, want .ts", ext)
+	}
+	if ext := audioExtension(); ext != ".aac" {
+		t.Errorf("audio extension %s, want .aac", ext)
+	}
+	mergePath := filepath.Join(dir, "out")
+	if err := mergeMediaFile(dir, mergePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mergePath + ".audio.aac"); err != nil {
+		t.Errorf("audio not merged by its own content type: %v", err)
+	}
+}
+
+// 同一个文件的多个字节范围同时下载，每个范围写入各自的文件，运行时加上-race检查
+func TestConcurrentByteRanges(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &parallel, 16)
+	const ranges = 64
+	data := make([]byte, ranges*tsPacketSize)
+	for i := 0; i < ranges; i++ {
+		copy(data[i*tsPacketSize:], tsData(1, byte(i)))
+	}
+	var playlist bytes.Buffer
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:1\n")
+	for i := 0; i < ranges; i++ {
+		// 第一个范围写偏移量，之后的紧接着上一个范围
+		if i == 0 {
+			fmt.Fprintf(&playlist, "#EXTINF:1,\n#EXT-X-BYTERANGE:%d@0\nmain.ts\n", tsPacketSize)
+		} else {
+			fmt.Fprintf(&playlist, "#EXTINF:1,\n#EXT-X-BYTERANGE:%d\nmain.ts\n", tsPacketSize)
+		}
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	srv := newSegmentServer(t, map[string][]byte{"/index.m3u8": playlist.Bytes(), "/main.ts": data})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if len(downloadProcess.MediaList) != ranges {
+		t.Fatalf("%d ranges in the list, want %d", len(downloadProcess.MediaList), ranges)
+	}
+	for i, name := range downloadProcess.MediaList {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[i*tsPacketSize:(i+1)*tsPacketSize]) {
+			t.Errorf("range %s has wrong content", name)
+		}
+	}
+	mergePath := filepath.Join(dir, "out")
+	if err := mergeMediaFile(dir, mergePath); err != nil {
+		t.Fatal(err)
+	}
+	if merged, _ := ioutil.ReadFile(mergePath + ".ts"); !bytes.Equal(merged, data) {
+		t.Errorf("merged ranges differ from the original file")
+	}
+}
+
+// 按顺序返回错误的transport，错误用完后返回ts内容或者指定的状态码
+type failingTransport struct {
+	errs   []error
+	status int
+	calls  int32
+}
+
+func (f *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := int(atomic.AddInt32(&f.calls, 1)) - 1
+	if i < len(f.errs) {
+		return nil, f.errs[i]
+	}
+	status := f.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(tsData(1, 0))),
+		Request:    req,
+	}, nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "cdn.example.com"}, true},
+		{"connection refused", refused, false},
+		{"wrapped connection refused", &url.Error{Op: "Get", URL: "http://cdn.example.com/a.ts", Err: refused}, false},
+		{"reset", syscall.ECONNRESET, true},
+		{"connection reset", reset, true},
+		{"wrapped connection reset", &url.Error{Op: "Get", URL: "http://cdn.example.com/a.ts", Err: reset}, true},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, true},
+		{"tls alert", &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, false},
+		{"timeout", timeoutError{}, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"server error", &statusError{503, "a.ts"}, true},
+		{"too many requests", &statusError{429, "a.ts"}, true},
+		{"not found", &statusError{404, "a.ts"}, false},
+		{"forbidden", &statusError{403, "a.ts"}, false},
+		{"other", errors.New("bad data"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 连接层的错误重试后成功，404不重试
+func TestRequestSegmentRetry(t *testing.T) {
+	resetDownload(t)
+	setGlobal(t, &retryWait, time.Millisecond)
+	setGlobal(t, &segmentRetry, 3)
+	v := &Download{URI: "http://cdn.example.com/a.ts", Name: "a.ts"}
+
+	flaky := &failingTransport{errs: []error{
+		&net.DNSError{Err: "no such host", Name: "cdn.example.com", IsTemporary: true},
+		&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		timeoutError{},
+	}}
+	resp, err := requestSegment(&http.Client{Transport: flaky}, v)
+	if err != nil {
+		t.Fatalf("request failed after transient errors: %v", err)
+	}
+	resp.Body.Close()
+	if flaky.calls != 4 {
+		t.Errorf("%d attempts, want 4", flaky.calls)
+	}
+
+	// 重试次数用完后返回最后的错误
+	down := &failingTransport{errs: make([]error, 10)}
+	for i := range down.errs {
+		down.errs[i] = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	if _, err := requestSegment(&http.Client{Transport: down}, v); err == nil {
+		t.Errorf("request succeeded while the server is down")
+	}
+	if down.calls != 4 {
+		t.Errorf("%d attempts, want 4", down.calls)
+	}
+
+	missing := &failingTransport{status: http.StatusNotFound}
+	if _, err := requestSegment(&http.Client{Transport: missing}, v); err == nil {
+		t.Errorf("404 treated as success")
+	}
+	if missing.calls != 1 {
+		t.Errorf("404 requested %d times, want 1", missing.calls)
+	}
+}
+
+// --duration对直播轮询到的新ts同样生效，一次轮询不会超出限制
+func TestDurationLimitsPolledWindow(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &maxDuration, 2500*time.Millisecond)
+	const head = "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	windows := []string{
+		head + "#EXTINF:1,\nseg0.ts\n#EXTINF:1,\nseg1.ts\n",
+		head + "#EXTINF:1,\nseg0.ts\n#EXTINF:1,\nseg1.ts\n#EXTINF:1,\nseg2.ts\n#EXTINF:1,\nseg3.ts\n#EXTINF:1,\nseg4.ts\n",
+	}
+	var polls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&polls, 1)) - 1
+		if i >= len(windows) {
+			i = len(windows) - 1
+		}
+		io.WriteString(w, windows[i])
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tsData(1, 0))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/live.m3u8", dir)
+
+	want := []string{"seg0.ts", "seg1.ts", "seg2.ts"}
+	if fmt.Sprint(downloadProcess.MediaList) != fmt.Sprint(want) {
+		t.Errorf("downloaded %v, want %v", downloadProcess.MediaList, want)
+	}
+	if n := atomic.LoadInt32(&polls); n != 2 {
+		t.Errorf("playlist fetched %d times, want 2", n)
+	}
+}
+
+// data:链接直接解码写入，blob:和空链接跳过，进度条总数不计入跳过的ts
+func TestUnsupportedSegmentUris(t *testing.T) {
+	dir := resetDownload(t)
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXTINF:4,\nseg0.ts\n" +
+		"#EXTINF:4,\ndata:video/mp2t;base64," + base64.StdEncoding.EncodeToString(tsData(1, 'd')) + "\n" +
+		"#EXTINF:4,\nblob:https://example.com/0d6c0e4e\n" +
+		"#EXTINF:4,\nseg1.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte(playlist),
+		"/seg0.ts":    tsData(1, 0),
+		"/seg1.ts":    tsData(1, 0),
+	})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	want := []string{"seg0.ts", "data_1.ts", "seg1.ts"}
+	if fmt.Sprint(downloadProcess.MediaList) != fmt.Sprint(want) {
+		t.Fatalf("media list %v, want %v", downloadProcess.MediaList, want)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "data_1.ts")); !bytes.Equal(got, tsData(1, 'd')) {
+		t.Errorf("data: segment not decoded")
+	}
+	if bar.Total() != 3 || bar.Current() != 3 {
+		t.Errorf("progress %d/%d, want 3/3", bar.Current(), bar.Total())
+	}
+	if n := atomic.LoadInt64(&failedCount); n != 0 {
+		t.Errorf("%d segments failed", n)
+	}
+}
+
+// m3u8文件中无法写出空链接，直接构造
+func TestSkipEmptyUri(t *testing.T) {
+	mpl, err := m3u8.NewMediaPlaylist(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpl.Append("a.ts", 4, "")
+	mpl.Append("", 4, "")
+	mpl.Append("blob:https://example.com/1", 4, "")
+	skips := make(map[int]bool)
+	skipUnsupported(mpl, skips)
+	if skips[0] || !skips[1] || !skips[2] {
+		t.Errorf("skips %v, want segments 1 and 2", skips)
+	}
+}
+
+// 没有结束标签的直播默认一直轮询，指定--live-idle-timeout后超时没有新的ts才结束，并记录为不再是直播
+func TestLiveIdleTimeout(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &liveIdleTimeout, 1500*time.Millisecond)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/live.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1,\nseg0.ts\n"),
+		"/seg0.ts":   tsData(1, 0),
+	})
+
+	start := time.Now()
+	downloadPlaylist(srv.URL+"/live.m3u8", dir)
+
+	if elapsed := time.Since(start); elapsed < liveIdleTimeout {
+		t.Errorf("stopped polling after %s, before the idle timeout", elapsed)
+	}
+	if downloadProcess.Live {
+		t.Errorf("process still marked live after idle timeout")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved DownloadProcess
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Live {
+		t.Errorf(".index still records a live playlist")
+	}
+}
+
+// --all-variants输出目录不存在时逐级创建，每个码率写在自己的子目录，不修改全局的输出路径
+func TestAllVariantsFreshRoot(t *testing.T) {
+	dir := resetDownload(t)
+	root := filepath.Join(dir, "new", "out")
+	setGlobal(t, &outPath, root)
+	srv := newSegmentServer(t, variantFiles())
+
+	if err := downloadAllVariants(srv.URL + "/master.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	if outPath != root {
+		t.Errorf("outPath changed to %s", outPath)
+	}
+	for _, v := range []struct {
+		dir  string
+		fill byte
+	}{{"v0", 'l'}, {"v1", 'h'}} {
+		for _, name := range []string{".index", localMediaName, "a.ts", "b.ts"} {
+			if _, err := os.Stat(filepath.Join(root, v.dir, name)); err != nil {
+				t.Errorf("%s/%s: %v", v.dir, name, err)
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, v.dir+".ts"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append(tsData(1, v.fill), tsData(1, v.fill)...); !bytes.Equal(data, want) {
+			t.Errorf("%s merged the wrong segments", v.dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, localMasterName)); err != nil {
+		t.Error(err)
+	}
+}
+
+// HEAD和空内容的响应不解压，HEAD的Content-Length仍然是压缩后的大小
+func TestDecodeBodilessResponses(t *testing.T) {
+	resetDownload(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/empty.ts" {
+			w.Header().Set("Content-Length", "0")
+			return
+		}
+		w.Header().Set("Content-Length", "1234")
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodHead, srv.URL+"/seg.ts", nil)
+	resp, err := doRequest(client, req)
+	if err != nil {
+		t.Fatalf("HEAD: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != 1234 {
+		t.Errorf("HEAD Content-Length %d, want the compressed 1234", resp.ContentLength)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/empty.ts", nil)
+	resp, err = doRequest(client, req)
+	if err != nil {
+		t.Fatalf("empty GET: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// 签名过期的ts按m3u8中的签名返回403，token小于valid时过期
+func signedServer(t *testing.T, valid int32, failRefresh bool) *httptest.Server {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			n := atomic.AddInt32(&fetches, 1)
+			if n > 1 && failRefresh {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts?token=%d\n#EXT-X-ENDLIST\n", n)
+			return
+		}
+		if token, _ := strconv.Atoi(r.URL.Query().Get("token")); int32(token) < valid {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(tsData(1, 0))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 重新获取签名时不使用m3u8缓存
+func TestRefreshBypassesManifestCache(t *testing.T) {
+	dir := resetDownload(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	setGlobal(t, &manifestCache, time.Hour)
+	srv := signedServer(t, 2, false)
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if n := atomic.LoadInt64(&failedCount); n != 0 {
+		t.Fatalf("%d segments failed, the refresh reused the cached playlist", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "seg0.ts")); err != nil {
+		t.Error(err)
+	}
+}
+
+// 重新获取m3u8失败时不退出，这个ts按失败统计
+func TestRefreshFailureCountsSegment(t *testing.T) {
+	dir := resetDownload(t)
+	srv := signedServer(t, 2, true)
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if n := atomic.LoadInt64(&failedCount); n != 1 {
+		t.Errorf("%d segments failed, want 1", n)
+	}
+}
+
+// ts个数超过新下载时的队列长度，队列满时等待下载协程取走，全部下载完成
+func TestLargePlaylistFreshDownload(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &parallel, 16)
+	const n = defaultQueueSize + 256
+	playlist := largePlaylist(n)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			w.Write(playlist)
+			return
+		}
+		w.Write(tsData(1, 0))
+	}))
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if len(downloadProcess.MediaList) != n {
+		t.Fatalf("%d segments queued, want %d", len(downloadProcess.MediaList), n)
+	}
+	if bar.Current() != n || atomic.LoadInt64(&failedCount) != 0 {
+		t.Errorf("%d of %d segments done, %d failed", bar.Current(), n, atomic.LoadInt64(&failedCount))
+	}
+}
+
+// 链接中已有的参数原样保留，同名的--query不覆盖，其它参数追加在后面
+func TestAddQueryParamsKeepsExisting(t *testing.T) {
+	params, err := parseQueryParams([]string{"token=new", "app=m3u8load"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &queryParams, params)
+	for _, c := range []struct{ in, want string }{
+		{"https://example.com/seg.ts", "https://example.com/seg.ts?app=m3u8load&token=new"},
+		{"https://example.com/seg.ts?z=1&sig=a%2Bb&token=old", "https://example.com/seg.ts?z=1&sig=a%2Bb&token=old&app=m3u8load"},
+		{"https://example.com/seg.ts?app=web&token=old", "https://example.com/seg.ts?app=web&token=old"},
+	} {
+		u, _ := url.Parse(c.in)
+		addQueryParams(u)
+		if u.String() != c.want {
+			t.Errorf("%s: got %s, want %s", c.in, u, c.want)
+		}
+	}
+}
+
+// 没有ts的m3u8不生成空的合并文件，返回错误
+func TestEmptyMediaPlaylist(t *testing.T) {
+	dir := resetDownload(t)
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "empty.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newSegmentServer(t, map[string][]byte{"/index.m3u8": data})
+	mergePath := filepath.Join(t.TempDir(), "out")
+	// 空列表的错误按--json-errors输出到stderr
+	setGlobal(t, &jsonErrors, true)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &os.Stderr, w)
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	w.Close()
+	stderr, _ := ioutil.ReadAll(r)
+	if !strings.Contains(string(stderr), `"level":"error","msg":"playlist contains no segments: `+srv.URL+`/index.m3u8"`) {
+		t.Errorf("stderr %q, want the empty playlist error", stderr)
+	}
+	err = writeAndMergeFile(dir, mergePath)
+
+	if err == nil || !strings.Contains(err.Error(), "no segments") {
+		t.Errorf("merge error %v, want no segments", err)
+	}
+	if bar.Total() != 0 {
+		t.Errorf("progress total %d, want 0", bar.Total())
+	}
+	if _, err := os.Stat(mergePath + mergeExtension()); !os.IsNotExist(err) {
+		t.Errorf("empty output file created: %v", err)
+	}
+}
+
+// -o末尾和重复的分隔符去掉后，合并文件和ts目录都在同一个路径
+func TestCleanOutPath(t *testing.T) {
+	dir := resetDownload(t)
+	sep := string(os.PathSeparator)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXT-X-ENDLIST\n"),
+		"/a.ts":       tsData(1, 0),
+	})
+	for i, in := range []string{"videos" + sep, "videos" + sep + sep, "out" + sep + sep + "videos" + sep} {
+		base := filepath.Join(dir, strconv.Itoa(i))
+		p := cleanOutPath(base + sep + in)
+		want := filepath.Join(base, in)
+		if p != want || strings.HasSuffix(p, sep) {
+			t.Errorf("%q cleaned to %q, want %q", in, p, want)
+			continue
+		}
+		setGlobal(t, &downloadProcess, &DownloadProcess{status: &sync.Map{}})
+		downloadPlaylist(srv.URL+"/index.m3u8", p)
+		if err := writeAndMergeFile(p, p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(want, "a.ts")); err != nil {
+			t.Errorf("%q: segment not in %s: %v", in, want, err)
+		}
+		if _, err := os.Stat(want + ".ts"); err != nil {
+			t.Errorf("%q: merged file not %s.ts: %v", in, want, err)
+		}
+	}
+	if cleanOutPath("") != "" {
+		t.Errorf("empty path changed")
+	}
+}
+
+// 没有请求Range时返回206，范围覆盖整个文件按成功处理，只有一部分时失败
+func TestFullRangePartialContent(t *testing.T) {
+	dir := resetDownload(t)
+	data := tsData(2, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end := len(data) - 1
+		if r.URL.Path == "/part.ts" {
+			end = tsPacketSize - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:end+1])
+	}))
+	defer srv.Close()
+
+	downloadAll(dir, []*Download{
+		{URI: srv.URL + "/full.ts", Name: "full.ts"},
+		{URI: srv.URL + "/part.ts", Name: "part.ts", Order: 1},
+	})
+
+	if !isDone("full.ts") {
+		t.Errorf("206 covering the whole file failed")
+	}
+	if isDone("part.ts") {
+		t.Errorf("206 with part of the file accepted")
+	}
+	for _, c := range []struct {
+		value string
+		want  bool
+	}{
+		{"bytes 0-999/1000", true},
+		{"bytes 0-998/1000", false},
+		{"bytes 1-999/1000", false},
+		{"bytes 0-999/*", false},
+		{"", false},
+	} {
+		if got := isFullContentRange(c.value); got != c.want {
+			t.Errorf("isFullContentRange(%q) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+// 共用客户端和每个下载协程单独客户端的吞吐量，高并发时比较连接池争用
+func BenchmarkClientPerWorker(b *testing.B) {
+	const segments = 256
+	data := tsData(350, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+	for _, perWorker := range []bool{false, true} {
+		name := "shared"
+		if perWorker {
+			name = "per-worker"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := resetDownload(b)
+			setGlobal(b, &parallel, 32)
+			setGlobal(b, &clientPerWorker, perWorker)
+			setGlobal(b, &workerClients, nil)
+			if err := setupClient(); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(segments * len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				downloadProcess.status = &sync.Map{}
+				list := make([]*Download, segments)
+				for j := range list {
+					list[j] = &Download{URI: fmt.Sprintf("%s/seg%d.ts", srv.URL, j), Name: fmt.Sprintf("seg%d.ts", j), Order: j}
+				}
+				downloadAll(dir, list)
+			}
+		})
+	}
+}
+
+// reverify-failed只使用记录了字节数并且大小一致的失败ts，截断在ts包边界的文件也重新下载
+func TestReverifyFailedNeedsSize(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &resumePolicy, "reverify-failed")
+	files := map[string][]byte{
+		"whole.ts":     tsData(4, 0),
+		"truncated.ts": tsData(2, 0),
+		"unknown.ts":   tsData(4, 0),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	downloadProcess.MediaList = []string{"whole.ts", "truncated.ts", "unknown.ts"}
+	downloadProcess.MediaStatus = map[string]bool{}
+	downloadProcess.Sizes = map[string]int64{
+		"whole.ts":     int64(len(tsData(4, 0))),
+		"truncated.ts": int64(len(tsData(4, 0))),
+	}
+
+	applyResumePolicy(dir)
+
+	want := map[string]bool{"whole.ts": true, "truncated.ts": false, "unknown.ts": false}
+	for name, done := range want {
+		if downloadProcess.MediaStatus[name] != done {
+			t.Errorf("%s done %v, want %v", name, downloadProcess.MediaStatus[name], done)
+		}
+	}
+
+	// 下载时按Content-Length记录字节数
+	srv := newSegmentServer(t, map[string][]byte{"/seg.ts": tsData(3, 0)})
+	downloadAll(dir, []*Download{{URI: srv.URL + "/seg.ts", Name: "seg.ts"}})
+	if size := downloadProcess.Sizes["seg.ts"]; size != int64(len(tsData(3, 0))) {
+		t.Errorf("recorded size %d, want %d", size, len(tsData(3, 0)))
+	}
+}
+
+// --refresh-url失败时返回错误，由调用方退出，对应上时替换链接
+func TestApplyRefreshUrlErrors(t *testing.T) {
+	resetDownload(t)
+	setGlobal(t, &refreshedUris, nil)
+	downloadProcess.MediaList = []string{"a.ts", "b.ts"}
+	srv := newSegmentServer(t, map[string][]byte{
+		"/ok.m3u8":     []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts?token=2\n#EXTINF:4,\nb.ts?token=2\n#EXT-X-ENDLIST\n"),
+		"/other.m3u8":  []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nx.ts\n#EXT-X-ENDLIST\n"),
+		"/master.m3u8": []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nok.m3u8\n"),
+	})
+	for _, c := range []struct {
+		path string
+		want string
+	}{
+		{"/missing.m3u8", "404"},
+		{"/other.m3u8", "does not match"},
+	} {
+		if err := applyRefreshUrl(srv.URL + c.path); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: error %v, want %q", c.path, err, c.want)
+		}
+	}
+	if err := applyRefreshUrl(srv.URL + "/master.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if downloadProcess.MediaUrl != srv.URL+"/ok.m3u8" || refreshedUris["a.ts"] != srv.URL+"/a.ts?token=2" {
+		t.Errorf("media url %s, refreshed %v", downloadProcess.MediaUrl, refreshedUris)
+	}
+}
+
+// 记录Sync次数的合并文件，关闭时返回closeErr
+type syncRecorder struct {
+	bytes.Buffer
+	syncs    int
+	closeErr error
+}
+
+func (r *syncRecorder) Sync() error  { r.syncs++; return nil }
+func (r *syncRecorder) Close() error { return r.closeErr }
+
+// --merge-sync 0只在最后同步一次，每隔N个ts同步时最后也同步，关闭失败时返回错误
+func TestMergeSyncAndClose(t *testing.T) {
+	dir := resetDownload(t)
+	list := []string{"a.ts", "b.ts", "c.ts"}
+	for _, name := range list {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), tsData(1, 0), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		every int
+		syncs int
+	}{{0, 1}, {2, 2}, {1, 4}} {
+		out := &syncRecorder{}
+		setGlobal(t, &DownloadOptions, &Options{CreateOutput: func(string) (io.WriteCloser, error) { return out, nil }})
+		setGlobal(t, &mergeSync, c.every)
+		if err := mergeFile(dir, filepath.Join(dir, "out.ts"), list); err != nil {
+			t.Fatal(err)
+		}
+		if out.syncs != c.syncs || out.Len() != 3*tsPacketSize {
+			t.Errorf("merge-sync %d: %d syncs and %d bytes, want %d syncs", c.every, out.syncs, out.Len(), c.syncs)
+		}
+	}
+
+	closeErr := errors.New("disk full")
+	DownloadOptions = &Options{CreateOutput: func(string) (io.WriteCloser, error) { return &syncRecorder{closeErr: closeErr}, nil }}
+	if err := mergeFile(dir, filepath.Join(dir, "out.ts"), list); !errors.Is(err, closeErr) {
+		t.Errorf("merge error %v, want the close error", err)
+	}
+}
+
+// 超过--max-playlist-size的m3u8返回错误，不解析
+func TestOversizedPlaylist(t *testing.T) {
+	resetDownload(t)
+	setGlobal(t, &maxPlaylistBytes, int64(1024))
+	srv := newSegmentServer(t, map[string][]byte{
+		"/big.m3u8":   largePlaylist(100),
+		"/small.m3u8": largePlaylist(1),
+	})
+
+	if _, _, _, err := requestPlaylist(srv.URL + "/big.m3u8"); err == nil || !strings.Contains(err.Error(), "larger than 1024 bytes") {
+		t.Errorf("oversized playlist error %v, want the size limit", err)
+	}
+	if _, _, _, err := requestPlaylist(srv.URL + "/small.m3u8"); err != nil {
+		t.Errorf("small playlist: %v", err)
+	}
+}
+
+// 按Accept返回内容的服务器，m3u8请求不带m3u8类型时返回网页，ts请求返回406
+func TestAcceptNegotiation(t *testing.T) {
+	dir := resetDownload(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			if !strings.Contains(accept, "application/vnd.apple.mpegurl") {
+				io.WriteString(w, "<html>not a playlist</html>")
+				return
+			}
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		if accept != "*/*" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Write(tsData(1, 0))
+	}))
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if !isDone("a.ts") {
+		t.Errorf("segment not downloaded with the negotiated Accept headers")
+	}
+
+	// --header可以覆盖默认的Accept
+	params, err := parseHeaders([]string{"Accept: text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &headers, params)
+	if _, _, _, err := requestPlaylist(srv.URL + "/index.m3u8"); err == nil {
+		t.Errorf("playlist parsed although --header replaced the Accept header")
+	}
+}
+
+// m3u8请求带--header和--playlist-header，同名时--playlist-header优先，ts请求只带--header
+func TestHeadersPerRequestType(t *testing.T) {
+	dir := resetDownload(t)
+	h, err := parseHeaders([]string{"Authorization: segment", "X-Cdn-Token: xyz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ph, err := parseHeaders([]string{"Authorization: Bearer playlist", "X-Api: 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &headers, h)
+	setGlobal(t, &playlistHeaders, ph)
+	var mu sync.Mutex
+	seen := make(map[string]http.Header)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path] = r.Header.Clone()
+		mu.Unlock()
+		if r.URL.Path == "/index.m3u8" {
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		w.Write(tsData(1, 0))
+	}))
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	for _, c := range []struct {
+		path, name, want string
+	}{
+		{"/index.m3u8", "Authorization", "Bearer playlist"},
+		{"/index.m3u8", "X-Api", "1"},
+		{"/index.m3u8", "X-Cdn-Token", "xyz"},
+		{"/a.ts", "Authorization", "segment"},
+		{"/a.ts", "X-Api", ""},
+		{"/a.ts", "X-Cdn-Token", "xyz"},
+	} {
+		if got := seen[c.path].Get(c.name); got != c.want {
+			t.Errorf("%s %s: %q, want %q", c.path, c.name, got, c.want)
+		}
+	}
+}
+
+// 超过--max-segment-size的ts标记失败并删除，创建文件失败时也只标记失败
+func TestMaxSegmentSize(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &maxSegmentSize, int64(2*tsPacketSize))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 不带Content-Length，边读边判断大小
+		w.Header().Set("Content-Type", "video/mp2t")
+		for i := 0; i < 4; i++ {
+			w.Write(tsData(1, 0))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	downloadAll(dir, []*Download{{URI: srv.URL + "/big.ts", Name: "big.ts"}})
+
+	if isDone("big.ts") || atomic.LoadInt64(&failedCount) != 1 {
+		t.Errorf("oversized segment accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.ts")); !os.IsNotExist(err) {
+		t.Errorf("oversized segment not removed: %v", err)
+	}
+
+	createErr := errors.New("read-only storage")
+	setGlobal(t, &DownloadOptions, &Options{CreateSegment: func(string) (io.WriteCloser, error) { return nil, createErr }})
+	setGlobal(t, &maxSegmentSize, int64(1<<30))
+	downloadAll(dir, []*Download{{URI: srv.URL + "/small.ts", Name: "small.ts"}})
+	if isDone("small.ts") || atomic.LoadInt64(&failedCount) != 2 {
+		t.Errorf("segment not counted as failed when the file can not be created")
+	}
+}
+
+// --strip-query时只有参数不同的链接对应同一个文件，请求时仍带完整的参数
+func TestStripQuery(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &stripQuery, true)
+	if a, b := getFileName("https://example.com/v/seg0.ts?token=1"), getFileName("https://example.com/v/seg0.ts?token=2&t=9"); a != "seg0.ts" || a != b {
+		t.Errorf("file names %q and %q, want seg0.ts", a, b)
+	}
+
+	var queries sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts?token=abc\n#EXT-X-ENDLIST\n"))
+			return
+		}
+		queries.Store(r.URL.Path, r.URL.RawQuery)
+		w.Write(tsData(1, 0))
+	}))
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if q, _ := queries.Load("/seg0.ts"); q != "token=abc" {
+		t.Errorf("segment requested with query %q, want token=abc", q)
+	}
+	if !isDone("seg0.ts") {
+		t.Errorf("segment not recorded as seg0.ts")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "seg0.ts")); err != nil {
+		t.Errorf("segment not saved without query: %v", err)
+	}
+}
+
+// 两种下载顺序的吞吐量，服务器每个ts延时1ms模拟网络
+func BenchmarkDownloadOrder(b *testing.B) {
+	const n = 200
+	seg := tsData(64, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write(seg)
+	}))
+	defer srv.Close()
+	for _, order := range []string{"any", "in-order"} {
+		b.Run(order, func(b *testing.B) {
+			setGlobal(b, &downloadOrder, order)
+			b.SetBytes(int64(n * len(seg)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := resetDownload(b)
+				setGlobal(b, &parallel, 8)
+				list := make([]*Download, n)
+				for j := range list {
+					name := fmt.Sprintf("seg%d.ts", j)
+					list[j] = &Download{URI: srv.URL + "/" + name, Name: name, Order: j}
+				}
+				b.StartTimer()
+				downloadAll(dir, list)
+			}
+		})
+	}
+}
+
+// 构造一个ts包，disc为true时带discontinuity_indicator
+func tsPacket(pid uint16, cc byte, payload, disc bool, fill byte) []byte {
+	p := tsData(1, fill)
+	p[1] = byte(pid >> 8 & 0x1f)
+	p[2] = byte(pid)
+	p[3] = cc & 0x0f
+	if payload {
+		p[3] |= 0x10
+	}
+	if disc || !payload {
+		p[3] |= 0x20
+		p[4] = 1
+		p[5] = 0
+		if disc {
+			p[5] = 0x80
+		}
+	}
+	return p
+}
+
+// 合并时重写连续计数，重复包和discontinuity_indicator的包不重新计数
+func TestContinuityWriter(t *testing.T) {
+	seg := func(packets ...[]byte) []byte { return bytes.Join(packets, nil) }
+	a := seg(tsPacket(0x100, 0, true, false, 1), tsPacket(0x100, 1, true, false, 2), tsPacket(0x100, 2, true, false, 3))
+	b := seg(tsPacket(0x100, 0, true, false, 4), tsPacket(0x100, 1, true, false, 5))
+	dup := tsPacket(0x100, 1, true, false, 2)
+	tests := []struct {
+		name  string
+		input [][]byte
+		// 每次写入的字节数，0表示按ts整段写入
+		chunk int
+		want  []byte
+	}{
+		{"aligned", [][]byte{a, b}, 0, []byte{0, 1, 2, 3, 4}},
+		{"split", [][]byte{a, b}, 100, []byte{0, 1, 2, 3, 4}},
+		{"duplicate", [][]byte{seg(a[:2*tsPacketSize], dup, a[2*tsPacketSize:]), b}, 0, []byte{0, 1, 1, 2, 3, 4}},
+		{"discontinuity", [][]byte{a, seg(tsPacket(0x100, 7, true, true, 6), tsPacket(0x100, 8, true, false, 7))}, 0, []byte{0, 1, 2, 7, 8}},
+		{"adaptation only", [][]byte{a, seg(tsPacket(0x100, 5, false, false, 8), b)}, 0, []byte{0, 1, 2, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := newContinuityWriter(&out)
+			for _, data := range tt.input {
+				size := tt.chunk
+				if size == 0 {
+					size = len(data)
+				}
+				for len(data) > 0 {
+					n := size
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := w.Write(data[:n]); err != nil {
+						t.Fatal(err)
+					}
+					data = data[n:]
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			var got []byte
+			for p := out.Bytes(); len(p) >= tsPacketSize; p = p[tsPacketSize:] {
+				got = append(got, p[3]&0x0f)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("continuity counters %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 保存在内存中的文件，用于测试自定义存储
+type memStore struct {
+	sync.Mutex
+	files map[string][]byte
+}
+
+type memFile struct {
+	bytes.Buffer
+	store *memStore
+	name  string
+}
+
+func (f *memFile) Close() error {
+	f.store.Lock()
+	f.store.files[f.name] = f.Bytes()
+	f.store.Unlock()
+	return nil
+}
+
+func (s *memStore) options() *Options {
+	create := func(name string) (io.WriteCloser, error) { return &memFile{store: s, name: name}, nil }
+	return &Options{
+		CreateSegment: create,
+		CreateOutput:  create,
+		OpenSegment: func(name string) (io.ReadCloser, error) {
+			s.Lock()
+			defer s.Unlock()
+			data, ok := s.files[name]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+		StatFile: func(name string) (int64, error) {
+			s.Lock()
+			defer s.Unlock()
+			data, ok := s.files[name]
+			if !ok {
+				return 0, os.ErrNotExist
+			}
+			return int64(len(data)), nil
+		},
+	}
+}
+
+// 自定义存储时断点续传、分段合并和校验都通过StatFile、OpenSegment读取，不访问本地文件
+func TestCustomStorageBackend(t *testing.T) {
+	dir := resetDownload(t)
+	store := &memStore{files: make(map[string][]byte)}
+	setGlobal(t, &DownloadOptions, store.options())
+	setGlobal(t, &splitCount, 2)
+	setGlobal(t, &splitPlan, nil)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXTINF:4,\nseg1.ts\n#EXTINF:4,\nseg2.ts\n#EXT-X-ENDLIST\n"),
+		"/seg0.ts":    tsData(1, 0),
+		"/seg1.ts":    tsData(2, 1),
+		"/seg2.ts":    tsData(3, 2),
+	})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	if _, err := os.Stat(filepath.Join(dir, "seg0.ts")); !os.IsNotExist(err) {
+		t.Errorf("segment written to the local directory: %v", err)
+	}
+	prefix := filepath.Join(dir, "out")
+	if err := writeAndMergeFile(dir, prefix); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{3, 3} {
+		name := partFileName(prefix, i+1, ".ts")
+		if got := len(store.files[name]) / tsPacketSize; got != want {
+			t.Errorf("%s has %d packets, want %d", name, got, want)
+		}
+	}
+	if !verifyList(dir, prefix, ".ts", downloadProcess.MediaList, downloadProcess.MediaStatus) {
+		t.Errorf("verify failed with the custom storage")
+	}
+
+	// 断点续传时已完成的ts还在存储中，不重新下载
+	delete(store.files, filepath.Join(dir, "seg1.ts"))
+	checkSegmentFiles(dir)
+	if !downloadProcess.MediaStatus["seg0.ts"] || downloadProcess.MediaStatus["seg1.ts"] {
+		t.Errorf("resume status %v, want only seg1.ts downloaded again", downloadProcess.MediaStatus)
+	}
+}
+
+// 分段合并时汇总中记录每段的文件名、包含的ts和大小
+func TestSplitPlanSummary(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &splitCount, 2)
+	setGlobal(t, &splitPlan, nil)
+	setGlobal(t, &summaryFile, filepath.Join(dir, "summary.json"))
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXTINF:4,\nseg1.ts\n#EXTINF:4,\nseg2.ts\n#EXT-X-ENDLIST\n"),
+		"/seg0.ts":    tsData(1, 0),
+		"/seg1.ts":    tsData(1, 1),
+		"/seg2.ts":    tsData(1, 2),
+	})
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	out := filepath.Join(dir, "out")
+	if err := writeAndMergeFile(dir, out); err != nil {
+		t.Fatal(err)
+	}
+	writeSummary(out, nil)
+
+	data, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary downloadSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	want := []mergedPart{
+		{Name: out + ".part1.ts", Segments: []string{"seg0.ts", "seg1.ts"}, Bytes: 2 * tsPacketSize},
+		{Name: out + ".part2.ts", Segments: []string{"seg2.ts"}, Bytes: tsPacketSize},
+	}
+	if fmt.Sprint(summary.Parts) != fmt.Sprint(want) {
+		t.Errorf("summary parts %v, want %v", summary.Parts, want)
+	}
+}
+
+// --probe-mirrors测速的m3u8请求和下载时一样带Accept和--playlist-header，选中的镜像记录到汇总
+func TestProbeMirrors(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &probeMirrors, true)
+	setGlobal(t, &summaryFile, filepath.Join(dir, "summary.json"))
+	ph, err := parseHeaders([]string{"X-Api: 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &playlistHeaders, ph)
+	seg := tsData(16, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/master.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nslow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nfast/index.m3u8\n")
+		case strings.HasSuffix(r.URL.Path, ".m3u8"):
+			if r.Header.Get("Accept") != playlistAccept || r.Header.Get("X-Api") != "1" {
+				http.Error(w, "missing playlist headers", http.StatusNotAcceptable)
+				return
+			}
+			// 带ETag，测速之后的下载不能收到304
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "index.m3u8", time.Time{}, strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n"))
+		default:
+			if strings.HasPrefix(r.URL.Path, "/slow/") {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.Write(seg)
+		}
+	}))
+	defer srv.Close()
+
+	downloadPlaylist(srv.URL+"/master.m3u8", dir)
+
+	if want := srv.URL + "/fast/index.m3u8"; downloadProcess.Mirror != want || downloadProcess.MediaUrl != want {
+		t.Errorf("mirror %q, media url %q, want %s", downloadProcess.Mirror, downloadProcess.MediaUrl, want)
+	}
+	if !isDone("seg0.ts") {
+		t.Errorf("segment of the fastest mirror not downloaded")
+	}
+	writeSummary(filepath.Join(dir, "out"), nil)
+	data, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary downloadSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Mirror != downloadProcess.Mirror {
+		t.Errorf("summary mirror %q, want %q", summary.Mirror, downloadProcess.Mirror)
+	}
+}
+
+// 达到--stop-after-bytes时不再分发新的ts，正在下载的ts结束后返回，不在下载协程中退出
+func TestStopAfterBytes(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &parallel, 1)
+	setGlobal(t, &retryFailed, 1)
+	setGlobal(t, &stopAfter, int64(2*tsPacketSize))
+	setGlobal(t, &budgetStop, make(chan struct{}))
+	setGlobal(t, &budgetClosed, 0)
+	files := make(map[string][]byte)
+	var list []*Download
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("seg%d.ts", i)
+		files["/"+name] = tsData(1, byte(i))
+		list = append(list, &Download{URI: "", Name: name})
+	}
+	srv := newSegmentServer(t, files)
+	for _, v := range list {
+		v.URI = srv.URL + "/" + v.Name
+	}
+
+	downloadAll(dir, list)
+	retryFailedSegments(dir)
+
+	if !budgetReached() {
+		t.Fatal("budget not reached")
+	}
+	done := 0
+	for _, v := range list {
+		if isDone(v.Name) {
+			done++
+		}
+	}
+	if done < 2 || done == len(list) {
+		t.Errorf("%d segments done, want the download stopped after 2", done)
+	}
+}
+
+// --concurrent-playlists不轮询直播，直播的音视频列表报错，不加入任何ts
+func TestConcurrentPlaylistsRejectsLive(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &concurrentPlaylists, true)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/master.m3u8": []byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\",DEFAULT=YES,URI=\"audio.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO=\"aac\"\nvideo.m3u8\n"),
+		"/video.m3u8":  []byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\nv0.ts\n"),
+		"/audio.m3u8":  []byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\na0.ts\n#EXT-X-ENDLIST\n"),
+		"/v0.ts":       tsData(1, 0),
+		"/a0.ts":       tsData(1, 1),
+	})
+
+	downloadPlaylist(srv.URL+"/master.m3u8", dir)
+
+	if n := len(downloadProcess.MediaList) + len(downloadProcess.AudioList); n != 0 {
+		t.Errorf("%d segments queued for a live playlist", n)
+	}
+}
+
+// 加密的ts原样保存，密钥链接和IV写入进度文件，没有IV时按媒体序列号生成
+func TestSegmentKeysSaved(t *testing.T) {
+	dir := resetDownload(t)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:4,\nplain.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"keys/k1\"\n#EXTINF:4,\na.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"https://kms.example.com/k2\",IV=0x0102\n#EXTINF:4,\nb.ts\n#EXT-X-ENDLIST\n"),
+		"/plain.ts": tsData(1, 0),
+		"/a.ts":     tsData(1, 1),
+		"/b.ts":     tsData(1, 2),
+	})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+
+	var saved DownloadProcess
+	load(filepath.Join(dir, ".index"), &saved)
+	want := map[string]SegmentKey{
+		"a.ts": {Method: "AES-128", URI: srv.URL + "/keys/k1", IV: fmt.Sprintf("0x%032x", 6)},
+		"b.ts": {Method: "AES-128", URI: "https://kms.example.com/k2", IV: "0x0102"},
+	}
+	if fmt.Sprint(saved.Keys) != fmt.Sprint(want) {
+		t.Errorf("saved keys %v, want %v", saved.Keys, want)
+	}
+}
+
+// --concurrent-merge时ts乱序完成，合并文件仍按列表顺序，和下载协程同时读写状态不产生竞争
+func TestConcurrentMergeOutOfOrder(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &parallel, 6)
+	setGlobal(t, &streamedOutput, "")
+	const n = 6
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:1\n"
+	var want []byte
+	for i := 0; i < n; i++ {
+		playlist += fmt.Sprintf("#EXTINF:1,\nseg%d.ts\n", i)
+		want = append(want, tsData(1, byte(i))...)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			io.WriteString(w, playlist)
+			return
+		}
+		var i int
+		fmt.Sscanf(r.URL.Path, "/seg%d.ts", &i)
+		// 越靠前的ts越晚完成
+		time.Sleep(time.Duration(n-i) * 20 * time.Millisecond)
+		w.Write(tsData(1, byte(i)))
+	}))
+	defer srv.Close()
+
+	mergePath := filepath.Join(t.TempDir(), "out")
+	stream := startMergeStream(dir, mergePath)
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	stream.wait()
+
+	if streamedOutput != mergePath+".ts" {
+		t.Fatalf("streamed output %q, want %s.ts", streamedOutput, mergePath)
+	}
+	got, err := ioutil.ReadFile(streamedOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("merged %d bytes out of order", len(got))
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 解析文件大小，支持K、M、G后缀，例如 500M
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size %q illegal, for example: 500M", value)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// 分段合并的一个文件和其中的ts，写入汇总
+type mergedPart struct {
+	Name     string   `json:"name"`
+	Segments []string `json:"segments"`
+	Bytes    int64    `json:"bytes"`
+}
+
+// 这次分段合并的所有文件，音频的分段接在视频后面
+var splitPlan []mergedPart
+
+// 按大小或者ts个数把列表分成多段，只在ts边界切分，每段都可以单独播放
+func splitList(outPath string, list []string, size int64, count int) [][]string {
+	if size <= 0 && count <= 0 {
+		return [][]string{list}
+	}
+	var parts [][]string
+	var part []string
+	var partSize int64
+	for _, value := range list {
+		var fileSize int64
+		if n, err := segmentSize(filepath.Join(outPath, filepath.FromSlash(value))); err == nil {
+			fileSize = n
+		}
+		// 当前段加上这个ts超过限制时另起一段，单个ts超过限制时单独一段
+		if len(part) > 0 && ((count > 0 && len(part) >= count) || (size > 0 && partSize+fileSize > size)) {
+			parts = append(parts, part)
+			part = nil
+			partSize = 0
+		}
+		part = append(part, value)
+		partSize += fileSize
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// 分段合并，文件名为 out.part1.ts、out.part2.ts，并输出每段包含的ts和大小
+func mergeParts(outPath string, prefix string, ext string, list []string, size int64, count int) error {
+	parts := splitList(outPath, list, size, count)
+	if len(parts) <= 1 {
+		return mergeFile(outPath, prefix+ext, list)
+	}
+	fmt.Printf("split %d segments into %d parts\n", len(list), len(parts))
+	first := 0
+	for i, part := range parts {
+		fileName := partFileName(prefix, i+1, ext)
+		if err := mergeFile(outPath, fileName, part); err != nil {
+			return err
+		}
+		partSize, _ := DownloadOptions.statFile(fileName)
+		splitPlan = append(splitPlan, mergedPart{Name: fileName, Segments: part, Bytes: partSize})
+		fmt.Printf("  %s: segments %d-%d, %d bytes\n", fileName, first, first+len(part)-1, partSize)
+		first += len(part)
+	}
+	return nil
+}
+
+// 第n段合并文件的名字，从1开始
+func partFileName(prefix string, n int, ext string) string {
+	return prefix + ".part" + strconv.Itoa(n) + ext
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 下载结束后的json汇总，字段保持稳定，方便其它程序解析
+type downloadSummary struct {
+	Url            string       `json:"url"`
+	MediaUrl       string       `json:"media_url"`
+	Output         string       `json:"output"`
+	Bandwidth      uint32       `json:"bandwidth"`
+	Resolution     string       `json:"resolution"`
+	Mirror         string       `json:"mirror,omitempty"`
+	Segments       int          `json:"segments"`
+	Completed      int          `json:"completed"`
+	Failed         int64        `json:"failed"`
+	Bytes          int64        `json:"bytes"`
+	ElapsedSeconds float64      `json:"elapsed_seconds"`
+	BytesPerSecond float64      `json:"bytes_per_second"`
+	Parts          []mergedPart `json:"parts,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+// 开始下载的时间，用于统计总耗时
+var summaryStart = time.Now()
+
+// --json-summary时输出汇总到stdout，或者写入--summary-file
+func writeSummary(output string, err error) {
+	if !jsonSummary && summaryFile == "" {
+		return
+	}
+	summary := downloadSummary{
+		Url:        m3u8Url,
+		MediaUrl:   downloadProcess.MediaUrl,
+		Output:     output + mergeExtension(),
+		Bandwidth:  downloadProcess.Bandwidth,
+		Resolution: downloadProcess.Resolution,
+		Mirror:     downloadProcess.Mirror,
+		Segments:   len(downloadProcess.MediaList) + len(downloadProcess.AudioList),
+		Failed:     atomic.LoadInt64(&failedCount),
+		Bytes:      atomic.LoadInt64(&downloadBytes),
+		Parts:      splitPlan,
+	}
+	for _, name := range append(append([]string{}, downloadProcess.MediaList...), downloadProcess.AudioList...) {
+		if isDone(name) {
+			summary.Completed++
+		}
+	}
+	summary.ElapsedSeconds = time.Since(summaryStart).Seconds()
+	if summary.ElapsedSeconds > 0 {
+		summary.BytesPerSecond = float64(summary.Bytes) / summary.ElapsedSeconds
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	data, _ := json.Marshal(summary)
+	if summaryFile != "" {
+		if err := ioutil.WriteFile(summaryFile, append(data, '\n'), fileMode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if jsonSummary {
+		fmt.Println(string(data))
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 重试失败的ts之前等待，给服务器恢复的时间
+const failedRetryDelay = 5 * time.Second
+
+// 所有ts下载一遍后，只重新下载失败的ts，最多--retry-failed轮，全部成功时按成功处理
+func retryFailedSegments(outPath string) {
+	for round := 1; round <= retryFailed; round++ {
+		// 达到--stop-after-bytes时剩下的ts留给下次运行
+		if budgetReached() {
+			return
+		}
+		failed := failedSegments()
+		if len(failed) == 0 {
+			return
+		}
+		fmt.Printf("\nretry %d failed segments in %v, round %d/%d\n", len(failed), failedRetryDelay, round, retryFailed)
+		time.Sleep(failedRetryDelay)
+
+		// 失败数只统计最后一轮
+		atomic.StoreInt64(&failedCount, 0)
+		atomic.StoreInt64(&notFoundCount, 0)
+		dlc := make(chan *Download, len(failed))
+		for _, v := range failed {
+			dlc <- v
+		}
+		close(dlc)
+		downloadSegmentLimit(outPath, dlc)
+	}
+}
+
+// 按列表顺序返回未完成的ts
+func failedSegments() []*Download {
+	downloadProcess.Lock()
+	media := append([]string{}, downloadProcess.MediaList...)
+	audio := append([]string{}, downloadProcess.AudioList...)
+	downloadProcess.Unlock()
+
+	var failed []*Download
+	for _, list := range [][]string{media, audio} {
+		for i, name := range list {
+			if isDone(name) {
+				continue
+			}
+			downloadProcess.Lock()
+			v := getContinueDownload(name)
+			v.Duration = downloadProcess.Durations[name]
+			downloadProcess.Unlock()
+			v.Order = i
+			failed = append(failed, v)
+		}
+	}
+	return failed
+}
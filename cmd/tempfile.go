@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// --temp-dir时ts先写入临时目录的.part文件，写完再移动到输出目录
+type tempSegment struct {
+	*os.File
+	name string
+}
+
+// 临时文件名按最终路径生成，不同子目录的同名ts不会冲突
+func createTempSegment(name string) (io.WriteCloser, error) {
+	sum := sha256.Sum256([]byte(name))
+	tmp := filepath.Join(tempDir, hex.EncodeToString(sum[:8])+".part")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	return &tempSegment{File: f, name: name}, nil
+}
+
+// 关闭后移动到输出目录
+func (t *tempSegment) Close() error {
+	if err := t.File.Close(); err != nil {
+		os.Remove(t.File.Name())
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.name), dirMode); err != nil {
+		return err
+	}
+	return moveFile(t.File.Name(), t.name)
+}
+
+// 下载失败时删除临时文件，不移动到输出目录
+func (t *tempSegment) Abort() error {
+	t.File.Close()
+	return os.Remove(t.File.Name())
+}
+
+// 下载失败时丢弃写了一半的ts
+func abortSegment(w io.WriteCloser) {
+	if a, ok := w.(interface{ Abort() error }); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+}
+
+// 重命名文件，临时目录和输出目录不在同一个设备时复制
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	// 先复制到输出目录的.part文件再重命名，中途失败不会留下不完整的ts
+	part := dst + ".part"
+	if err := copyFile(src, part); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
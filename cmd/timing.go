@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --timing-csv的输出，每个ts一行，多个下载协程同时写入需要加锁
+var (
+	timingWriter *csv.Writer
+	timingLock   sync.Mutex
+)
+
+// 创建耗时统计文件并写入表头，断点续传时追加
+func openTimingCsv(name string) error {
+	info, statErr := os.Stat(name)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	timingWriter = csv.NewWriter(f)
+	if statErr != nil || info.Size() == 0 {
+		timingWriter.Write([]string{"segment", "uri", "start", "duration_ms", "bytes", "bytes_per_second", "status"})
+		timingWriter.Flush()
+	}
+	return timingWriter.Error()
+}
+
+// 记录一个ts的开始时间、耗时、字节数和速度，status为http状态码或者error
+func writeTiming(v *Download, start time.Time, n int64, status string) {
+	if timingWriter == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	var speed int64
+	if elapsed > 0 {
+		speed = int64(float64(n) / elapsed.Seconds())
+	}
+	timingLock.Lock()
+	defer timingLock.Unlock()
+	timingWriter.Write([]string{
+		v.Name,
+		v.URI,
+		start.Format(time.RFC3339Nano),
+		strconv.FormatInt(elapsed.Milliseconds(), 10),
+		strconv.FormatInt(n, 10),
+		strconv.FormatInt(speed, 10),
+		status,
+	})
+	timingWriter.Flush()
+}
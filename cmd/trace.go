@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// 请求各阶段耗时统计
+type traceStats struct {
+	sync.Mutex
+	requests     int
+	reused       int
+	dnsCount     int
+	connectCount int
+	tlsCount     int
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	firstByte    time.Duration
+}
+
+var requestTrace = &traceStats{}
+
+// 给请求加上httptrace，收到第一个字节时记录DNS、连接、TLS和首字节耗时
+func withTrace(req *http.Request) *http.Request {
+	var mu sync.Mutex
+	var start, dnsStart, connectStart, tlsStart time.Time
+	var dns, connect, tlsTime time.Duration
+	var reused bool
+
+	start = time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			dns = time.Since(dnsStart)
+			mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			mu.Lock()
+			connect = time.Since(connectStart)
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			tlsTime = time.Since(tlsStart)
+			mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			reused = info.Reused
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			requestTrace.add(reused, dns, connect, tlsTime, time.Since(start))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (s *traceStats) add(reused bool, dns, connect, tlsTime, firstByte time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	if reused {
+		s.reused++
+	}
+	if dns > 0 {
+		s.dnsCount++
+		s.dns += dns
+	}
+	if connect > 0 {
+		s.connectCount++
+		s.connect += connect
+	}
+	if tlsTime > 0 {
+		s.tlsCount++
+		s.tls += tlsTime
+	}
+	s.firstByte += firstByte
+}
+
+// 输出平均耗时和连接复用率
+func (s *traceStats) print() {
+	s.Lock()
+	defer s.Unlock()
+	if s.requests == 0 {
+		return
+	}
+	fmt.Printf("requests: %d, connection reused: %.1f%%\n", s.requests, float64(s.reused)*100/float64(s.requests))
+	fmt.Printf("avg dns: %v, avg connect: %v, avg tls: %v, avg first byte: %v\n",
+		average(s.dns, s.dnsCount), average(s.connect, s.connectCount), average(s.tls, s.tlsCount), average(s.firstByte, s.requests))
+}
+
+func average(total time.Duration, count int) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	return (total / time.Duration(count)).Round(time.Millisecond)
+}
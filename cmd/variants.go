@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"log"
+	"net/url"
+)
+
+// 码率信息
+type variantInfo struct {
+	Bandwidth        uint32  `json:"bandwidth"`
+	AverageBandwidth uint32  `json:"average_bandwidth,omitempty"`
+	Resolution       string  `json:"resolution,omitempty"`
+	Codecs           string  `json:"codecs,omitempty"`
+	FrameRate        float64 `json:"frame_rate,omitempty"`
+	Audio            string  `json:"audio,omitempty"`
+	Subtitles        string  `json:"subtitles,omitempty"`
+	Iframe           bool    `json:"iframe,omitempty"`
+	URL              string  `json:"url"`
+}
+
+// 音频、字幕等其它版本信息
+type renditionInfo struct {
+	Type     string `json:"type"`
+	GroupId  string `json:"group_id"`
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Default  bool   `json:"default"`
+	URL      string `json:"url,omitempty"`
+}
+
+// 以json格式输出master playlist的所有码率和音频字幕
+func listVariants(urlStr string) {
+	playlistUrl, err := url.Parse(urlStr)
+	if err != nil {
+		log.Panic(err)
+	}
+	playlist, listType, _ := fetchPlaylist(urlStr)
+	if listType != m3u8.MASTER {
+		fmt.Println("not a master playlist, no variants to list")
+		return
+	}
+
+	mpl := playlist.(*m3u8.MasterPlaylist)
+	result := struct {
+		Variants   []variantInfo   `json:"variants"`
+		Renditions []renditionInfo `json:"renditions"`
+	}{}
+	seen := make(map[string]bool)
+	for _, v := range mpl.Variants {
+		result.Variants = append(result.Variants, variantInfo{
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Resolution:       v.Resolution,
+			Codecs:           v.Codecs,
+			FrameRate:        v.FrameRate,
+			Audio:            v.Audio,
+			Subtitles:        v.Subtitles,
+			Iframe:           v.Iframe,
+			URL:              getAbsoluteUri(v.URI, playlistUrl),
+		})
+		// 同一个音频字幕可能挂在多个码率下，去重
+		for _, alt := range v.Alternatives {
+			if alt == nil {
+				continue
+			}
+			key := alt.Type + "|" + alt.GroupId + "|" + alt.Name + "|" + alt.URI
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			info := renditionInfo{
+				Type:     alt.Type,
+				GroupId:  alt.GroupId,
+				Language: alt.Language,
+				Name:     alt.Name,
+				Default:  alt.Default,
+			}
+			if alt.URI != "" {
+				info.URL = getAbsoluteUri(alt.URI, playlistUrl)
+			}
+			result.Renditions = append(result.Renditions, info)
+		}
+	}
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(data))
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// 等待校验的ts，--verify时下载完成后放入
+var verifyQueue chan *Download
+var verifyWg sync.WaitGroup
+
+// 启动校验协程，和下载协程分开，不占用下载的并发数
+func startVerifiers(outPath string) {
+	if !verifySegments {
+		return
+	}
+	verifyQueue = make(chan *Download, parallel*2)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		verifyWg.Add(1)
+		go func() {
+			defer verifyWg.Done()
+			for v := range verifyQueue {
+				if err := verifySegment(outPath, v); err != nil {
+					// 删除损坏的ts，重新运行时会重新下载
+					log.Printf("Verify segment failed for %v: %v\n", v.URI, err)
+					os.Remove(filepath.Join(outPath, filepath.FromSlash(v.Name)))
+					failSegment(v, err)
+				}
+			}
+		}()
+	}
+}
+
+// 所有ts下载完成后等待校验结束
+func stopVerifiers() {
+	if verifyQueue == nil {
+		return
+	}
+	close(verifyQueue)
+	verifyWg.Wait()
+	verifyQueue = nil
+}
+
+// 下载完成的ts放入校验队列
+func queueVerify(v *Download) {
+	if verifyQueue != nil {
+		verifyQueue <- v
+	}
+}
+
+// 重新读取ts文件，和下载时的sha256比对，ts格式的文件还要检查每个包的同步字节
+func verifySegment(outPath string, v *Download) error {
+	f, err := DownloadOptions.openSegment(filepath.Join(outPath, filepath.FromSlash(v.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	downloadProcess.Lock()
+	expected := downloadProcess.Checksums[v.Name]
+	contentType := downloadProcess.ContentType
+	if strings.HasPrefix(v.Name, audioDir+"/") {
+		contentType = downloadProcess.AudioContentType
+	}
+	downloadProcess.Unlock()
+
+	hash := sha256.New()
+	var reader io.Reader = io.TeeReader(f, hash)
+	// 加密的ts开头不是同步字节，只能比对sha256
+	br := bufio.NewReader(reader)
+	reader = br
+	if getExtension([]string{v.Name}, contentType) == ".ts" && isTsData(br) {
+		if err := checkTsPackets(br); err != nil {
+			return err
+		}
+	}
+	// 读完剩余的内容再比对sha256
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return err
+	}
+	if expected != "" && hex.EncodeToString(hash.Sum(nil)) != expected {
+		return errors.New("checksum mismatch, the file was not completely written")
+	}
+	return nil
+}
+
+// 检查每个完整的ts包都以同步字节开始
+func checkTsPackets(r *bufio.Reader) error {
+	packet := make([]byte, tsPacketSize)
+	for {
+		_, err := io.ReadFull(r, packet)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if packet[0] != tsSyncByte {
+			return errors.New("lost mpeg-ts sync byte")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <out path>",
+	Short: "check the downloaded segments of an output path",
+	Long:  `check the .index of an output path, report present, complete and missing segments and the merged file size, without downloading anything`,
+	Args:  cobra.ExactArgs(1),
+	Run:   verifyFunc,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+func verifyFunc(cmd *cobra.Command, args []string) {
+	ok, err := verifyOutput(filepath.Clean(args[0]))
+	if err != nil {
+		exitWithError(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// 检查-o目录的进度文件，--flat时ts和进度文件在临时目录，合并文件仍然按-o的路径
+func verifyOutput(dir string) (bool, error) {
+	segDir := dir
+	name := filepath.Join(segDir, ".index")
+	if _, err := os.Stat(name); err != nil {
+		segDir = flatPath(dir)
+		name = filepath.Join(segDir, ".index")
+	}
+	if _, err := os.Stat(name); err != nil {
+		return false, fmt.Errorf("index file %s not found", filepath.Join(dir, ".index"))
+	}
+
+	process := &DownloadProcess{}
+	load(name, process)
+	// 按下载时记录的方式读取ts
+	compressSegments = process.Compressed
+
+	// 进度文件记录了合并文件时按记录的路径检查，--name、--ext改过名字也能找到
+	prefix, ext := dir, getExtension(process.MediaList, process.ContentType)
+	if process.MergePath != "" {
+		prefix, ext = process.MergePath, process.MergeExt
+	}
+	ok := verifyList(segDir, prefix, ext, process.MediaList, process.MediaStatus)
+	// 音频单独合并，单独检查
+	if len(process.AudioList) > 0 {
+		ok = verifyList(segDir, prefix+".audio", getExtension(process.AudioList, process.AudioContentType), process.AudioList, process.MediaStatus) && ok
+	}
+	return ok, nil
+}
+
+// 检查ts文件是否下载完成，合并文件大小是否等于所有ts文件之和，prefix为合并文件不带扩展名的路径
+func verifyList(dir string, prefix string, ext string, list []string, status map[string]bool) bool {
+	var complete, present, missing int
+	var size int64
+	for _, value := range list {
+		n, err := segmentSize(filepath.Join(dir, filepath.FromSlash(value)))
+		if err != nil || n == 0 {
+			missing++
+			fmt.Println("missing: " + value)
+			continue
+		}
+		size += n
+		if status[value] {
+			complete++
+		} else {
+			// 文件存在但是没有标记完成，可能只下载了一部分
+			present++
+			fmt.Println("incomplete: " + value)
+		}
+	}
+
+	fmt.Printf("%s: %d segments, %d complete, %d incomplete, %d missing\n", prefix+ext, len(list), complete, present, missing)
+
+	files := mergedFiles(prefix, ext)
+	if len(files) == 0 {
+		fmt.Println("merged file " + prefix + ext + " not found")
+		return false
+	}
+	var merged int64
+	for _, file := range files {
+		n, err := DownloadOptions.statFile(file)
+		if err != nil {
+			fmt.Println("merged file " + file + " not found")
+			return false
+		}
+		merged += n
+	}
+	if merged != size {
+		fmt.Printf("merged file size %d does not match segments size %d\n", merged, size)
+		return false
+	}
+	if len(files) > 1 {
+		fmt.Printf("merged into %d parts, total size %d ok\n", len(files), merged)
+	} else {
+		fmt.Printf("merged file size %d ok\n", merged)
+	}
+	return present == 0 && missing == 0
+}
+
+// 合并后的文件，--split-size、--split-count时为 out.part1.ts、out.part2.ts 等，和mergeParts的命名一致
+func mergedFiles(prefix string, ext string) []string {
+	if _, err := DownloadOptions.statFile(prefix + ext); err == nil {
+		return []string{prefix + ext}
+	}
+	var files []string
+	for i := 1; ; i++ {
+		name := partFileName(prefix, i, ext)
+		if _, err := DownloadOptions.statFile(name); err != nil {
+			return files
+		}
+		files = append(files, name)
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 在dir中写入ts文件和进度文件
+func writeVerifyFixture(t *testing.T, dir string, segments map[string][]byte) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	process := &DownloadProcess{MediaStatus: make(map[string]bool)}
+	for _, name := range []string{"a.ts", "b.ts", "c.ts"} {
+		if data, ok := segments[name]; ok {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			process.MediaList = append(process.MediaList, name)
+			process.MediaStatus[name] = true
+		}
+	}
+	data, _ := json.Marshal(process)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".index"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySplitParts(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	writeVerifyFixture(t, dir, map[string][]byte{"a.ts": tsData(1, 0), "b.ts": tsData(1, 0), "c.ts": tsData(1, 0)})
+	ioutil.WriteFile(partFileName(dir, 1, ".ts"), tsData(2, 0), 0644)
+	ioutil.WriteFile(partFileName(dir, 2, ".ts"), tsData(1, 0), 0644)
+
+	ok, err := verifyOutput(dir)
+	if err != nil || !ok {
+		t.Errorf("split download reported broken: %v", err)
+	}
+
+	// 少了一段时大小不一致
+	os.Remove(partFileName(dir, 2, ".ts"))
+	if ok, _ := verifyOutput(dir); ok {
+		t.Errorf("missing part reported ok")
+	}
+}
+
+func TestVerifyFlat(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	segDir := flatPath(dir)
+	t.Cleanup(func() { os.RemoveAll(segDir) })
+	writeVerifyFixture(t, segDir, map[string][]byte{"a.ts": tsData(1, 0), "b.ts": tsData(1, 0)})
+	ioutil.WriteFile(dir+".ts", tsData(2, 0), 0644)
+
+	ok, err := verifyOutput(dir)
+	if err != nil || !ok {
+		t.Errorf("flat download reported broken: %v", err)
+	}
+}
+
+// 中断后换一个--name继续下载，复用-o目录中的ts，合并到新的名字，verify按记录的合并文件检查
+func TestResumeToRenamedTarget(t *testing.T) {
+	dir := resetDownload(t)
+	var fail int32 = 1
+	var requests sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		n, _ := requests.LoadOrStore(r.URL.Path, new(int32))
+		atomic.AddInt32(n.(*int32), 1)
+		if r.URL.Path == "/b.ts" && atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(tsData(1, 'x'))
+	}))
+	defer srv.Close()
+
+	// 第一次b.ts失败，不合并
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	if err := writeAndMergeFile(dir, dir); err == nil {
+		t.Fatal("merged with a failed segment")
+	}
+
+	// 换名字继续
+	atomic.StoreInt32(&fail, 0)
+	atomic.StoreInt64(&failedCount, 0)
+	setGlobal(t, &downloadProcess, &DownloadProcess{status: &sync.Map{}})
+	setGlobal(t, &forceExt, "mpg")
+	renamed := filepath.Join(t.TempDir(), "renamed")
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	if err := writeAndMergeFile(dir, renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := requests.Load("/a.ts"); atomic.LoadInt32(n.(*int32)) != 1 {
+		t.Errorf("a.ts requested %d times, want the finished segment reused", *n.(*int32))
+	}
+	data, err := ioutil.ReadFile(renamed + ".mpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, append(tsData(1, 'x'), tsData(1, 'x')...)) {
+		t.Errorf("renamed output has %d bytes", len(data))
+	}
+	if _, err := os.Stat(dir + ".ts"); !os.IsNotExist(err) {
+		t.Errorf("merged file also written under the old name: %v", err)
+	}
+	ok, err := verifyOutput(dir)
+	if err != nil || !ok {
+		t.Errorf("verify %v %v, want the renamed output found", ok, err)
+	}
+}
+
+// --compress-segments时ts压缩保存，合并和verify按解压后的内容和大小
+func TestCompressedSegments(t *testing.T) {
+	dir := resetDownload(t)
+	setGlobal(t, &compressSegments, true)
+	segments := map[string][]byte{"/seg0.ts": tsData(4, 0), "/seg1.ts": tsData(2, 1)}
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXTINF:4,\nseg1.ts\n#EXT-X-ENDLIST\n"),
+		"/seg0.ts":    segments["/seg0.ts"],
+		"/seg1.ts":    segments["/seg1.ts"],
+	})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	if err := writeAndMergeFile(dir, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "seg0.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(stored, segments["/seg0.ts"]) {
+		t.Errorf("segment stored uncompressed")
+	}
+	merged, err := ioutil.ReadFile(dir + ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, append(append([]byte{}, segments["/seg0.ts"]...), segments["/seg1.ts"]...)) {
+		t.Errorf("merged file is not the decompressed segments")
+	}
+	// verify不依赖这次的参数，按进度文件的记录解压后比较大小
+	compressSegments = false
+	if ok, err := verifyOutput(dir); err != nil || !ok {
+		t.Errorf("verify = %v, %v, want ok", ok, err)
+	}
+}
+
+// 没有压缩保存时，内容恰好以gzip文件头开始的ts原样合并
+func TestUncompressedGzipLikeSegment(t *testing.T) {
+	dir := resetDownload(t)
+	data := append([]byte{0x1f, 0x8b}, make([]byte, 100)...)
+	srv := newSegmentServer(t, map[string][]byte{
+		"/index.m3u8": []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n"),
+		"/seg0.ts":    data,
+	})
+
+	downloadPlaylist(srv.URL+"/index.m3u8", dir)
+	if err := writeAndMergeFile(dir, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := ioutil.ReadFile(dir + ".ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, data) {
+		t.Errorf("merged %d bytes, want the segment as downloaded", len(merged))
+	}
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (w *countingWriter) Close() error { return nil }
+
+// --compress-segments的CPU和空间开销：video为随机负载模拟已压缩的视频，zeros为容易压缩的数据
+func BenchmarkCompressSegment(b *testing.B) {
+	video := tsData(5000, 0)
+	rand.New(rand.NewSource(1)).Read(video)
+	for i := 0; i < len(video); i += tsPacketSize {
+		video[i] = tsSyncByte
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{{"video", video}, {"zeros", tsData(5000, 0)}} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(c.data)))
+			var out countingWriter
+			for i := 0; i < b.N; i++ {
+				out.n = 0
+				w := newGzipSegment(&out)
+				w.Write(c.data)
+				w.Close()
+			}
+			b.ReportMetric(float64(out.n)/float64(len(c.data))*100, "%size")
+		})
+	}
+}